@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+)
+
+// recordAudit appends an entry to the audit log. The operation has already happened
+// at this point, so a failure is logged instead of failing the request
+func (app *application) recordAudit(r *http.Request, actorID string, action string, target string, changes map[string]any) {
+	err := app.modelsFor(r).Audit.Record(actorID, action, target, changes)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// requestActorID returns the ID of the authenticated user, or an empty string for
+// anonymous requests
+func (app *application) requestActorID(r *http.Request) string {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return ""
+	}
+
+	return user.ID
+}
+
+func (app *application) listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ActorID string
+		Action  string
+		data.Filters
+	}
+
+	v := app.newValidator(r)
+
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "actor_id", "action", "page", "page_size", "sort")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.ActorID = app.readString(qs, "actor_id", "")
+	input.Action = app.readString(qs, "action", "")
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Sort = app.readString(qs, "sort", "-created_at")
+	input.SortSafeList = []string{"created_at", "-created_at"}
+
+	v.Check(input.ActorID == "" || validator.IsUUID(input.ActorID), "actor_id", "must be a valid user ID")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	entries, metadata, err := app.modelsFor(r).Audit.GetAll(input.ActorID, input.Action, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"audit_log": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
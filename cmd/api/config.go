@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	port       int
+	env        string
+	basePath   string
+	jsonPretty bool
+	// verboseErrors adds the underlying error to the 500 responses, see serverErrorResponse()
+	verboseErrors bool
+	// profileDefaults are the defaults of the env profile applied to the flags which
+	// weren't set by any other layer, see envProfiles
+	profileDefaults map[string]string
+	// timezone is the IANA name of the timezone of the timestamps in the responses
+	// when the request doesn't ask for one, timezoneLocation is the loaded timezone
+	timezone         string
+	timezoneLocation *time.Location
+
+	// trustedProxies are the IPs or CIDR ranges of the proxies allowed to tell us
+	// the original scheme and host of the request with the X-Forwarded-* headers
+	trustedProxies []string
+	// publicURL is the scheme and host of the absolute URLs in the responses, when
+	// empty they are taken from the request
+	publicURL string
+	// frontend is the web app, when baseURL is set the emails link to its pages
+	frontend struct {
+		baseURL         string
+		activationPath  string
+		emailChangePath string
+	}
+
+	db struct {
+		dsn                string
+		maxConns           int
+		minConns           int
+		maxIdleTime        time.Duration
+		acquireTimeout     time.Duration
+		tagQueries         bool
+		retryAttempts      int
+		retryBackoff       time.Duration
+		breakerThreshold   int
+		breakerCooldown    time.Duration
+		slowQueryThreshold time.Duration
+		// warmup opens the minConns connections before the server starts, and
+		// healthCheckInterval is how often the database is pinged in the background
+		warmup              bool
+		healthCheckInterval time.Duration
+	}
+	server struct {
+		h2c             bool
+		maxQueryLength  int
+		maxQueryParams  int
+		idleTimeout     time.Duration
+		readTimeout     time.Duration
+		writeTimeout    time.Duration
+		shutdownTimeout time.Duration
+		// maxConcurrent caps the requests handled at the same time, the excess ones
+		// wait up to concurrencyWait for a slot before being rejected
+		maxConcurrent   int
+		concurrencyWait time.Duration
+	}
+	tls struct {
+		certFile   string
+		keyFile    string
+		minVersion string
+		curves     []string
+	}
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+		// warningThreshold is the fraction of the burst under which the responses
+		// warn the client that it's approaching the limit
+		warningThreshold float64
+	}
+	smtp struct {
+		host        string
+		port        int
+		username    string
+		password    string
+		sender      string
+		concurrency int
+		maxBodySize int
+	}
+	mailer struct {
+		backend string
+		dir     string
+	}
+	// featureFlagsRefresh is how long the feature flags are cached
+	featureFlagsRefresh time.Duration
+	// background is the retry policy of the best-effort background tasks
+	background struct {
+		retryAttempts int
+		retryBackoff  time.Duration
+	}
+	// requestLog logs every request once it has been handled. Only one in every
+	// sampleRate successful requests is logged, sampleRoutes overrides the rate of
+	// specific routes
+	requestLog struct {
+		enabled       bool
+		sampleRate    int
+		sampleRoutes  []string
+		slowThreshold time.Duration
+	}
+	// debugBodies logs the request and response bodies, only in development
+	debugBodies struct {
+		enabled      bool
+		maxSize      int
+		redactFields []string
+	}
+	healthcheck struct {
+		mailer  bool
+		timeout time.Duration
+	}
+	movieCache struct {
+		size int
+		ttl  time.Duration
+	}
+	uniqueMovies bool
+	// editConflictRetries is how many times an update sent with X-Retry-On-Conflict
+	// is retried when the movie is changed concurrently
+	editConflictRetries int
+	// genres is the controlled vocabulary of the movie genres, any genre is allowed
+	// when it's empty
+	genres []string
+	// movieSort is the sort of the movies list when the request doesn't have one
+	movieSort string
+	// readOnly rejects the requests which change data, see the readOnlyMode() middleware
+	readOnly bool
+	// strictQuery rejects the requests with query params the endpoint doesn't know
+	strictQuery bool
+	cors        struct {
+		trustedOrigins   []string
+		allowedMethods   []string
+		allowedHeaders   []string
+		maxAge           time.Duration
+		allowCredentials bool
+	}
+	basicAuth struct {
+		username string
+		password string
+	}
+	passwordPolicy     data.PasswordPolicy
+	passwordHash       string
+	activationRequired bool
+	maxTokensPerUser   int
+	tokens             struct {
+		slidingWindow time.Duration
+		maxLifetime   time.Duration
+		hashSecret    string
+		hashLegacy    bool
+	}
+	securityHeaders struct {
+		noSniff        bool
+		frameOptions   string
+		referrerPolicy string
+		hstsMaxAge     int
+		server         string
+	}
+}
+
+// stringList is a flag.Value holding a space separated list of values
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+
+	return strings.Join(*s, " ")
+}
+
+func (s *stringList) Set(val string) error {
+	*s = strings.Fields(val)
+	return nil
+}
+
+// commaList is a flag.Value for the lists whose items can contain spaces, like the
+// movie genres. The items are separated by commas and trimmed
+type commaList []string
+
+func (c *commaList) String() string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.Join(*c, ",")
+}
+
+func (c *commaList) Set(val string) error {
+	*c = nil
+	for item := range strings.SplitSeq(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*c = append(*c, item)
+		}
+	}
+	return nil
+}
+
+// envProfiles are the defaults of each environment. They are applied on top of the
+// defaults declared with the flags, so the config file, the env vars and the command
+// line flags can still override any of them. The config file can change them with
+// the profiles key, e.g. `profiles: {staging: {limiter: {enabled: true}}}`
+var envProfiles = map[string]map[string]string{
+	"development": {
+		"json-pretty":    "true",
+		"verbose-errors": "true",
+	},
+	"staging": {},
+	"production": {
+		"limiter-enabled": "true",
+	},
+}
+
+// envAliases maps flag names to env var names that don't follow the default naming
+// convention (the flag name in upper case with dashes replaced by underscores)
+var envAliases = map[string]string{
+	"db-dsn": "DATABASE_URL",
+}
+
+// loadConfig builds the application config. Every setting is declared as a flag and
+// its value is resolved in the following order, where each layer overrides the
+// previous one:
+//
+//  1. the default value declared with the flag
+//  2. the defaults of the profile of the environment (-env), see envProfiles
+//  3. the config file passed with -config (YAML or JSON)
+//  4. environment variables
+//  5. flags explicitly passed on the command line
+func loadConfig(args []string) (config, error) {
+	var cfg config
+	var configFile string
+
+	flag.StringVar(&configFile, "config", "", "Path to a YAML or JSON config file")
+
+	flag.IntVar(&cfg.port, "port", 4000, "API server port")
+	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.basePath, "base-path", "/v1", "Base path of the API routes (e.g. /api/v1)")
+	flag.Var((*stringList)(&cfg.trustedProxies), "trusted-proxies", "IPs or CIDR ranges of the proxies trusted to set X-Forwarded-Proto and X-Forwarded-Host (space separated)")
+	flag.StringVar(&cfg.publicURL, "public-url", "", "Scheme and host used in absolute URLs (e.g. https://api.greenlight.com), taken from the request when empty")
+	flag.StringVar(&cfg.frontend.baseURL, "frontend-base-url", "", "URL of the web app (e.g. https://greenlight.com/app), the emails link to its pages when set")
+	flag.StringVar(&cfg.frontend.activationPath, "frontend-activation-path", "/activate", "Page of the web app which activates the account with the token query param")
+	flag.StringVar(&cfg.frontend.emailChangePath, "frontend-email-change-path", "/confirm-email", "Page of the web app which confirms an email change with the token query param")
+	flag.StringVar(&cfg.timezone, "timezone", "UTC", "IANA timezone of the timestamps in the responses (e.g. America/Lima), requests can override it with ?tz= or X-Timezone")
+	flag.BoolVar(&cfg.jsonPretty, "json-pretty", false, "Indent the JSON responses (on by default in development)")
+	flag.BoolVar(&cfg.verboseErrors, "verbose-errors", false, "Include the underlying error in the 500 responses (on by default in development)")
+
+	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+	flag.IntVar(&cfg.db.maxConns, "db-max-conns", 30, "PostgreSQL max open connections")
+	flag.IntVar(&cfg.db.minConns, "db-min-conns", 0, "PostgreSQL connections kept open even when idle")
+	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	flag.BoolVar(&cfg.db.warmup, "db-warmup", false, "Open the db-min-conns connections before serving requests, so the first requests don't pay for establishing them")
+	flag.DurationVar(&cfg.db.healthCheckInterval, "db-health-check-interval", 0, "Ping the database in the background every interval, logging and publishing in /debug/vars when it fails (0 disables it)")
+	flag.DurationVar(&cfg.db.acquireTimeout, "db-acquire-timeout", time.Second, "Maximum wait for a free connection of the pool before responding that the server is busy (0 disables it)")
+	flag.BoolVar(&cfg.db.tagQueries, "db-tag-queries", false, "Prepend a comment with the request ID to the queries, to find the request of a query in the PostgreSQL logs (the tagged queries aren't prepared, which costs an extra round trip each)")
+	flag.IntVar(&cfg.db.retryAttempts, "db-retry-attempts", 3, "Max attempts for queries failing with transient errors (1 disables retries)")
+	flag.DurationVar(&cfg.db.retryBackoff, "db-retry-backoff", 100*time.Millisecond, "Initial backoff between query retries")
+	flag.DurationVar(&cfg.db.slowQueryThreshold, "db-slow-query-threshold", 0, "Log queries slower than this duration (0 disables it)")
+	flag.IntVar(&cfg.db.breakerThreshold, "db-breaker-threshold", 5, "Consecutive database failures that open the circuit breaker (0 disables it)")
+	flag.DurationVar(&cfg.db.breakerCooldown, "db-breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before testing the database again")
+
+	flag.BoolVar(&cfg.server.h2c, "h2c", false, "Enable HTTP/2 without TLS (h2c, prior knowledge only)")
+	flag.DurationVar(&cfg.server.idleTimeout, "server-idle-timeout", time.Minute, "HTTP server idle timeout")
+	flag.DurationVar(&cfg.server.readTimeout, "server-read-timeout", 5*time.Second, "HTTP server read timeout")
+	flag.DurationVar(&cfg.server.writeTimeout, "server-write-timeout", 10*time.Second, "HTTP server write timeout")
+	flag.DurationVar(&cfg.server.shutdownTimeout, "server-shutdown-timeout", 30*time.Second, "Graceful shutdown timeout")
+	flag.IntVar(&cfg.server.maxQueryLength, "server-max-query-length", 2048, "Maximum length in bytes of the URL query string (0 means unlimited)")
+	flag.IntVar(&cfg.server.maxConcurrent, "server-max-concurrent", 0, "Maximum number of requests handled at the same time, the excess ones get a 503 (0 means unlimited)")
+	flag.DurationVar(&cfg.server.concurrencyWait, "server-concurrency-wait", 0, "How long a request over server-max-concurrent waits for a slot before being rejected (0 rejects it right away)")
+	flag.IntVar(&cfg.server.maxQueryParams, "server-max-query-params", 50, "Maximum number of URL query parameters (0 means unlimited)")
+
+	// TLS is only enabled when both the certificate and the key are set
+	flag.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "TLS certificate file, serves HTTPS when set along with -tls-key-file")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key-file", "", "TLS private key file")
+	flag.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version (1.2, or 1.3 for the modern only profile)")
+	flag.Var((*stringList)(&cfg.tls.curves), "tls-curves", "Key exchange curves in order of preference (space separated, e.g. X25519MLKEM768 X25519 P256), empty uses the Go defaults")
+
+	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", false, "Enable rate limiter")
+	flag.Float64Var(&cfg.limiter.warningThreshold, "limiter-warning-threshold", 0.2, "Send the X-RateLimit-Warning header when the remaining requests of a client are under this fraction of its burst (0 disables it)")
+
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.com>", "SMTP sender")
+	flag.IntVar(&cfg.smtp.concurrency, "smtp-concurrency", 2, "Maximum number of emails sent at the same time")
+	flag.IntVar(&cfg.smtp.maxBodySize, "smtp-max-body-size", 1<<20, "Maximum size in bytes of the rendered subject and bodies of an email (0 means no limit)")
+
+	flag.StringVar(&cfg.mailer.backend, "mailer-backend", "smtp", "How emails are delivered: smtp, or file to write them to -mailer-dir (development only)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "tmp/emails", "Directory of the .eml files written by the file mailer backend")
+
+	flag.DurationVar(&cfg.featureFlagsRefresh, "feature-flags-refresh", 10*time.Second, "How often the feature flags are reloaded from the database")
+
+	flag.IntVar(&cfg.background.retryAttempts, "background-retry-attempts", 3, "Number of attempts of the background tasks, such as sending emails, before they are recorded as failed")
+	flag.DurationVar(&cfg.background.retryBackoff, "background-retry-backoff", time.Second, "Wait before the second attempt of a background task, doubled after every attempt")
+
+	flag.BoolVar(&cfg.requestLog.enabled, "request-log-enabled", false, "Log every request once it has been handled")
+	flag.IntVar(&cfg.requestLog.sampleRate, "request-log-sample", 1, "Log only one in every N successful requests (1 logs them all), errors are always logged")
+	flag.Var((*commaList)(&cfg.requestLog.sampleRoutes), "request-log-sample-routes", "Sample rates of specific routes overriding request-log-sample (comma separated, e.g. GET /v1/movies/:id=100)")
+	flag.DurationVar(&cfg.requestLog.slowThreshold, "request-log-slow-threshold", time.Second, "Requests slower than this are always logged (0 disables it)")
+
+	flag.BoolVar(&cfg.debugBodies.enabled, "debug-log-bodies", false, "Log the request and response bodies (development only)")
+	flag.IntVar(&cfg.debugBodies.maxSize, "debug-log-bodies-max-size", 2048, "Maximum number of bytes logged of each body")
+	cfg.debugBodies.redactFields = []string{"password", "token", "key", "authentication_token", "activation_token"}
+	flag.Var((*stringList)(&cfg.debugBodies.redactFields), "debug-log-bodies-redact", "JSON fields whose values are redacted from the logged bodies (space separated, case insensitive)")
+
+	flag.BoolVar(&cfg.healthcheck.mailer, "healthcheck-mailer", false, "Check that the SMTP server is reachable in the healthcheck")
+	flag.DurationVar(&cfg.healthcheck.timeout, "healthcheck-timeout", 2*time.Second, "Timeout of each healthcheck sub-check")
+
+	flag.IntVar(&cfg.movieCache.size, "movie-cache-size", 0, "Number of movies kept in the in-memory cache (0 disables it)")
+	flag.DurationVar(&cfg.movieCache.ttl, "movie-cache-ttl", time.Minute, "How long movies are kept in the in-memory cache")
+	flag.BoolVar(&cfg.uniqueMovies, "unique-movies", false, "Reject new movies with the same title and year than an existing one")
+	flag.IntVar(&cfg.editConflictRetries, "edit-conflict-retries", 3, "Number of retries of the movie updates sent with X-Retry-On-Conflict on an edit conflict")
+	flag.Var((*commaList)(&cfg.genres), "genres", "Allowed movie genres (comma separated), any genre is allowed when empty")
+	flag.StringVar(&cfg.movieSort, "movie-default-sort", "id", "Default sort of the movies list")
+	flag.BoolVar(&cfg.readOnly, "read-only", false, "Reject the requests which change data with a 503, e.g. during database maintenance (admins can toggle it at runtime)")
+	flag.BoolVar(&cfg.strictQuery, "strict-query-params", false, "Reject requests with unknown query params instead of ignoring them")
+
+	cfg.cors.trustedOrigins = []string{"http://localhost:9000", "http://localhost:9002"}
+	flag.Var((*stringList)(&cfg.cors.trustedOrigins), "cors-trusted-origins", "Trusted CORS origins (space separated, * allows any origin)")
+	cfg.cors.allowedMethods = []string{"OPTIONS", "PUT", "PATCH", "DELETE"}
+	flag.Var((*stringList)(&cfg.cors.allowedMethods), "cors-allowed-methods", "Methods allowed in CORS preflight requests (space separated)")
+	cfg.cors.allowedHeaders = []string{"Authorization", "Content-Type"}
+	flag.Var((*stringList)(&cfg.cors.allowedHeaders), "cors-allowed-headers", "Headers allowed in CORS preflight requests (space separated)")
+	flag.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers can cache CORS preflight responses (0 doesn't set the header)")
+	flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests")
+
+	// basic auth credentials used by monitoring tools that can't send bearer tokens.
+	// When the username is empty, basic auth is disabled
+	flag.StringVar(&cfg.basicAuth.username, "basic-auth-username", "", "Basic auth username for the metrics endpoint")
+	flag.StringVar(&cfg.basicAuth.password, "basic-auth-password", "", "Basic auth password for the metrics endpoint")
+
+	// when activation isn't required, new users are created already activated and the
+	// activation email is not sent
+	flag.BoolVar(&cfg.activationRequired, "activation-required", true, "Require new users to activate their account by email")
+	flag.DurationVar(&cfg.tokens.slidingWindow, "token-sliding-window", 0, "Extend the authentication tokens on each use so they expire after this inactivity window (0 disables sliding sessions)")
+	flag.DurationVar(&cfg.tokens.maxLifetime, "token-max-lifetime", 30*24*time.Hour, "Maximum lifetime of the authentication tokens extended by sliding sessions")
+	// with a secret the tokens are stored as HMAC-SHA256 hashes instead of plain SHA-256
+	// ones, the legacy hashes are accepted until the tokens made without it expire
+	flag.StringVar(&cfg.tokens.hashSecret, "token-hash-secret", "", "Secret used to hash the tokens with HMAC-SHA256 (empty hashes them with plain SHA-256)")
+	flag.BoolVar(&cfg.tokens.hashLegacy, "token-hash-legacy", true, "Also accept the tokens hashed with plain SHA-256 when token-hash-secret is set")
+	flag.IntVar(&cfg.maxTokensPerUser, "max-tokens-per-user", 10, "Maximum number of active authentication tokens per user, the oldest ones are deleted (0 means unlimited)")
+
+	// password strength rules applied on registration, all of them are disabled by default
+	flag.IntVar(&cfg.passwordPolicy.MinCharacterClasses, "password-min-character-classes", 0, "Minimum number of character classes (lowercase, uppercase, digits, symbols) in new passwords")
+	flag.BoolVar(&cfg.passwordPolicy.RejectCommon, "password-reject-common", false, "Reject common passwords")
+	flag.BoolVar(&cfg.passwordPolicy.RejectEmail, "password-reject-email", false, "Reject passwords containing the email local part")
+
+	flag.StringVar(&cfg.passwordHash, "password-hash", data.PasswordHashBcrypt, "Algorithm used to hash new passwords (bcrypt or argon2id), existing hashes keep working")
+
+	// Every security header can be disabled by setting it to an empty string (or
+	// false for the nosniff one)
+	flag.BoolVar(&cfg.securityHeaders.noSniff, "security-headers-nosniff", true, "Set the X-Content-Type-Options: nosniff header")
+	flag.StringVar(&cfg.securityHeaders.frameOptions, "security-headers-frame-options", "DENY", "X-Frame-Options header value")
+	flag.StringVar(&cfg.securityHeaders.referrerPolicy, "security-headers-referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy header value")
+	flag.IntVar(&cfg.securityHeaders.hstsMaxAge, "security-headers-hsts-max-age", 63072000, "Strict-Transport-Security max-age in seconds (0 disables it)")
+	flag.StringVar(&cfg.securityHeaders.server, "server-header", "", "Server header value (empty removes it)")
+
+	// First pass: we need to know the config file path before applying any layer
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	if configFile != "" {
+		err = applyConfigFile(configFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err = applyEnv()
+	if err != nil {
+		return cfg, err
+	}
+
+	// Second pass: explicit flags always win, so we parse them again on top of the
+	// values set by the config file and the env vars
+	err = flag.CommandLine.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	// the env is only known once every layer has been applied, so its profile fills
+	// in the flags that are still unset at the end
+	cfg.profileDefaults, err = applyProfile(cfg.env)
+	if err != nil {
+		return cfg, err
+	}
+
+	// an unknown timezone leaves the location nil, which is reported by validate()
+	cfg.timezoneLocation, _ = loadLocation(cfg.timezone)
+
+	return cfg, cfg.validate()
+}
+
+// envName returns the env var name used to override the given flag
+func envName(flagName string) string {
+	if alias, ok := envAliases[flagName]; ok {
+		return alias
+	}
+
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyProfile sets the defaults of the profile of env to the flags which haven't been
+// set by the config file, the env vars or the command line, and returns the ones it set
+func applyProfile(env string) (map[string]string, error) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	applied := map[string]string{}
+	var errs []error
+
+	for name, value := range envProfiles[env] {
+		if set[name] {
+			continue
+		}
+
+		err := flag.Set(name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for %q in the %s profile: %w", name, env, err))
+			continue
+		}
+
+		applied[name] = value
+	}
+
+	return applied, errors.Join(errs...)
+}
+
+func applyEnv() error {
+	var errs []error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+
+		err := flag.Set(f.Name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for env var %s: %w", envName(f.Name), err))
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// applyConfigFile reads a YAML or JSON config file and sets the matching flags.
+// Nested keys are joined with dashes, so `limiter: {rps: 2}` sets the -limiter-rps
+// flag, and lists are joined with spaces.
+func applyConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	values := map[string]any{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// UseNumber() keeps numbers as their literal text, otherwise big integers
+		// would be formatted with an exponent when converting them back to strings
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	default:
+		return fmt.Errorf("unsupported config file extension %q (expected .json, .yaml or .yml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse config file: %w", err)
+	}
+
+	var errs []error
+
+	// the profiles aren't flags, they change the defaults applied by applyProfile()
+	if profiles, ok := values["profiles"]; ok {
+		delete(values, "profiles")
+
+		errs = append(errs, applyConfigProfiles(profiles))
+	}
+
+	flattened := map[string]string{}
+	flattenConfigValues("", values, flattened)
+
+	for name, value := range flattened {
+		if name == "config" || flag.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("unknown config file key %q", name))
+			continue
+		}
+
+		err := flag.Set(name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for config file key %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyConfigProfiles merges the profiles key of the config file into envProfiles
+func applyConfigProfiles(profiles any) error {
+	envs, ok := profiles.(map[string]any)
+	if !ok {
+		return errors.New("the profiles config file key must map each env to its defaults")
+	}
+
+	var errs []error
+
+	for env, defaults := range envs {
+		if _, ok := envProfiles[env]; !ok {
+			errs = append(errs, fmt.Errorf("unknown env %q in the profiles config file key", env))
+			continue
+		}
+
+		values, ok := defaults.(map[string]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("the %s profile must be a map of settings", env))
+			continue
+		}
+
+		flattened := map[string]string{}
+		flattenConfigValues("", values, flattened)
+
+		for name, value := range flattened {
+			if name == "config" || name == "env" || flag.Lookup(name) == nil {
+				errs = append(errs, fmt.Errorf("unknown key %q in the %s profile", name, env))
+				continue
+			}
+
+			envProfiles[env][name] = value
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func flattenConfigValues(prefix string, values map[string]any, dest map[string]string) {
+	for key, value := range values {
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			flattenConfigValues(name, v, dest)
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			separator := " "
+			if f := flag.Lookup(name); f != nil {
+				if _, ok := f.Value.(*commaList); ok {
+					separator = ","
+				}
+			}
+			dest[name] = strings.Join(items, separator)
+		default:
+			dest[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+func (cfg config) validate() error {
+	var errs []error
+
+	check := func(ok bool, message string) {
+		if !ok {
+			errs = append(errs, errors.New(message))
+		}
+	}
+
+	check(cfg.port > 0 && cfg.port <= 65535, "port must be between 1 and 65535")
+	check(slices.Contains([]string{"development", "staging", "production"}, cfg.env), "env must be one of development, staging or production")
+
+	check(cfg.timezoneLocation != nil, fmt.Sprintf("timezone %q is not a known IANA timezone", cfg.timezone))
+
+	check(cfg.basePath == "" || (strings.HasPrefix(cfg.basePath, "/") && !strings.HasSuffix(cfg.basePath, "/")), "base-path must start with a slash and must not end with one")
+
+	check(cfg.db.dsn != "", "db-dsn must be provided")
+	check(cfg.db.maxConns > 0, "db-max-conns must be greater than zero")
+	check(cfg.db.minConns >= 0 && cfg.db.minConns <= cfg.db.maxConns, "db-min-conns must be between 0 and db-max-conns")
+	check(!cfg.db.warmup || cfg.db.minConns > 0, "db-warmup requires db-min-conns to be greater than zero")
+	check(cfg.db.maxIdleTime > 0, "db-max-idle-time must be greater than zero")
+	check(cfg.db.healthCheckInterval >= 0, "db-health-check-interval must not be negative")
+	check(cfg.db.acquireTimeout >= 0, "db-acquire-timeout must not be negative")
+	check(cfg.db.retryAttempts > 0, "db-retry-attempts must be greater than zero")
+	check(cfg.db.retryBackoff >= 0, "db-retry-backoff must not be negative")
+	check(cfg.db.slowQueryThreshold >= 0, "db-slow-query-threshold must not be negative")
+	check(cfg.db.breakerThreshold >= 0, "db-breaker-threshold must not be negative")
+	check(cfg.db.breakerCooldown > 0, "db-breaker-cooldown must be greater than zero")
+
+	check(cfg.server.idleTimeout > 0, "server-idle-timeout must be greater than zero")
+	check(cfg.server.readTimeout > 0, "server-read-timeout must be greater than zero")
+	check(cfg.server.writeTimeout > 0, "server-write-timeout must be greater than zero")
+	check(cfg.server.shutdownTimeout > 0, "server-shutdown-timeout must be greater than zero")
+	check(cfg.server.maxQueryLength >= 0, "server-max-query-length must not be negative")
+	check(cfg.server.maxQueryParams >= 0, "server-max-query-params must not be negative")
+	check(cfg.server.maxConcurrent >= 0, "server-max-concurrent must not be negative")
+	check(cfg.server.concurrencyWait >= 0, "server-concurrency-wait must not be negative")
+
+	check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert-file and tls-key-file must be set together")
+	_, ok := tlsVersions[cfg.tls.minVersion]
+	check(ok, "tls-min-version must be one of 1.2 or 1.3")
+	for _, curve := range cfg.tls.curves {
+		_, ok := tlsCurves[curve]
+		check(ok, fmt.Sprintf("tls-curves has an unknown curve %q", curve))
+	}
+
+	if cfg.limiter.enabled {
+		check(cfg.limiter.rps > 0, "limiter-rps must be greater than zero")
+		check(cfg.limiter.burst > 0, "limiter-burst must be greater than zero")
+		check(cfg.limiter.warningThreshold >= 0 && cfg.limiter.warningThreshold < 1, "limiter-warning-threshold must be between 0 and 1")
+	}
+
+	_, err := parseTrustedProxies(cfg.trustedProxies)
+	check(err == nil, fmt.Sprintf("trusted-proxies is invalid: %v", err))
+
+	if cfg.publicURL != "" {
+		u, err := url.Parse(cfg.publicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == "",
+			"public-url must be an http or https URL without a path")
+	}
+
+	if cfg.frontend.baseURL != "" {
+		u, err := url.Parse(cfg.frontend.baseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.RawQuery == "" && u.Fragment == "",
+			"frontend-base-url must be an http or https URL without a query string")
+	}
+	check(strings.HasPrefix(cfg.frontend.activationPath, "/"), "frontend-activation-path must start with /")
+	check(strings.HasPrefix(cfg.frontend.emailChangePath, "/"), "frontend-email-change-path must start with /")
+
+	check(cfg.featureFlagsRefresh >= 0, "feature-flags-refresh must not be negative")
+
+	check(cfg.background.retryAttempts >= 1, "background-retry-attempts must be at least 1")
+	check(cfg.background.retryBackoff >= 0, "background-retry-backoff must not be negative")
+	check(cfg.requestLog.sampleRate >= 1, "request-log-sample must be at least 1")
+	_, err = parseSampleRoutes(cfg.requestLog.sampleRoutes)
+	check(err == nil, fmt.Sprintf("request-log-sample-routes is invalid: %v", err))
+	check(cfg.requestLog.slowThreshold >= 0, "request-log-slow-threshold must not be negative")
+	check(!cfg.debugBodies.enabled || cfg.env == "development", "debug-log-bodies is only allowed in development")
+	check(cfg.debugBodies.maxSize > 0, "debug-log-bodies-max-size must be greater than zero")
+
+	check(cfg.healthcheck.timeout > 0, "healthcheck-timeout must be greater than zero")
+
+	// an empty username disables basic auth, so a password without one is a mistake
+	check(cfg.basicAuth.password == "" || strings.TrimSpace(cfg.basicAuth.username) != "", "basic-auth-username must be provided when basic-auth-password is set")
+	check(cfg.basicAuth.username == "" || cfg.basicAuth.password != "", "basic-auth-password must be provided when basic-auth-username is set")
+	check(!strings.Contains(cfg.basicAuth.username, ":"), "basic-auth-username must not contain a colon")
+
+	check(cfg.movieCache.size >= 0, "movie-cache-size must not be negative")
+	check(cfg.editConflictRetries >= 0, "edit-conflict-retries must not be negative")
+	check(validator.Unique(cfg.genres), "genres must not contain duplicated values")
+	check(slices.Contains(movieSortSafeList, cfg.movieSort), fmt.Sprintf("movie-default-sort must be one of %s", strings.Join(movieSortSafeList, ", ")))
+	check(cfg.movieCache.ttl > 0, "movie-cache-ttl must be greater than zero")
+
+	check(!cfg.cors.allowCredentials || !slices.Contains(cfg.cors.trustedOrigins, "*"), "cors-trusted-origins must not contain * when cors-allow-credentials is enabled")
+	check(cfg.cors.maxAge >= 0, "cors-max-age must not be negative")
+
+	check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port must be between 1 and 65535")
+	check(cfg.smtp.concurrency > 0, "smtp-concurrency must be greater than zero")
+	check(cfg.smtp.maxBodySize >= 0, "smtp-max-body-size must not be negative")
+	check(cfg.mailer.backend == "smtp" || cfg.mailer.backend == "file", "mailer-backend must be one of smtp or file")
+	check(cfg.mailer.backend != "file" || cfg.env == "development", "mailer-backend=file is only allowed in development")
+	check(cfg.mailer.backend != "file" || cfg.mailer.dir != "", "mailer-dir must be provided when mailer-backend is file")
+	check(cfg.maxTokensPerUser >= 0, "max-tokens-per-user must not be negative")
+	check(cfg.tokens.slidingWindow >= 0, "token-sliding-window must not be negative")
+	check(cfg.tokens.maxLifetime >= cfg.tokens.slidingWindow, "token-max-lifetime must not be shorter than token-sliding-window")
+	check(cfg.tokens.hashSecret == "" || len(cfg.tokens.hashSecret) >= 32, "token-hash-secret must be at least 32 bytes long")
+	check(cfg.passwordPolicy.MinCharacterClasses >= 0 && cfg.passwordPolicy.MinCharacterClasses <= 4, "password-min-character-classes must be between 0 and 4")
+	check(slices.Contains([]string{data.PasswordHashBcrypt, data.PasswordHashArgon2id}, cfg.passwordHash), "password-hash must be one of bcrypt or argon2id")
+	check(cfg.securityHeaders.hstsMaxAge >= 0, "security-headers-hsts-max-age must not be negative")
+
+	return errors.Join(errs...)
+}
+
+// effectiveConfig returns the resolved value of every flag as slog attributes,
+// redacting the ones that contain secrets
+func effectiveConfig() []any {
+	var attrs []any
+
+	flag.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, f.Name, redactConfigValue(f.Name, f.Value.String()))
+	})
+
+	return attrs
+}
+
+// profileAttrs returns the env and the defaults its profile applied as slog
+// attributes, sorted by flag name
+func profileAttrs(cfg config) []any {
+	attrs := []any{"env", cfg.env}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.profileDefaults)) {
+		attrs = append(attrs, name, redactConfigValue(name, cfg.profileDefaults[name]))
+	}
+
+	return attrs
+}
+
+func redactConfigValue(name string, value string) string {
+	if value == "" {
+		return value
+	}
+
+	if name == "db-dsn" {
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" {
+			return "xxxxx"
+		}
+		return u.Redacted()
+	}
+
+	if strings.Contains(name, "password") || strings.Contains(name, "secret") {
+		return "xxxxx"
+	}
+
+	return value
+}
+
+// sampleRoute is the sample rate of the requests whose method and path match a route
+// pattern like the ones of httprouter, e.g. GET /v1/movies/:id
+type sampleRoute struct {
+	method   string
+	segments []string
+	rate     int
+}
+
+// matches reports whether the request is for the route. A :name segment matches any
+// segment and a *name segment matches the rest of the path
+func (sr sampleRoute) matches(method string, path string) bool {
+	if method != sr.method {
+		return false
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	for i, segment := range sr.segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			return true
+		case i >= len(segments):
+			return false
+		case strings.HasPrefix(segment, ":"):
+			if segments[i] == "" {
+				return false
+			}
+		case segment != segments[i]:
+			return false
+		}
+	}
+
+	return len(segments) == len(sr.segments)
+}
+
+// parseSampleRoutes parses a list of "<method> <route pattern>=<rate>" values
+func parseSampleRoutes(values []string) ([]sampleRoute, error) {
+	routes := make([]sampleRoute, 0, len(values))
+
+	for _, value := range values {
+		route, rate, ok := strings.Cut(value, "=")
+		method, pattern, ok2 := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !ok2 || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("%q must look like GET /v1/movies=100", value)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(rate))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("the rate of %q must be at least 1", value)
+		}
+
+		routes = append(routes, sampleRoute{
+			method:   strings.ToUpper(method),
+			segments: strings.Split(strings.TrimPrefix(pattern, "/"), "/"),
+			rate:     n,
+		})
+	}
+
+	return routes, nil
+}
+
+// parseTrustedProxies parses a list of IPs and CIDR ranges, where a single IP is
+// treated as a range containing only that IP
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+
+	for _, value := range values {
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
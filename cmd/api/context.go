@@ -3,13 +3,24 @@ package main
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/i18n"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	localeContextKey      = contextKey("locale")
+	permissionsContextKey = contextKey("permissions")
+	clientAddrContextKey  = contextKey("clientAddr")
+	requestIDContextKey   = contextKey("requestID")
+	schemeContextKey      = contextKey("scheme")
+	hostContextKey        = contextKey("host")
+	timezoneContextKey    = contextKey("timezone")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -24,3 +35,159 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (app *application) contextSetLocale(r *http.Request, locale string) *http.Request {
+	ctx := context.WithValue(r.Context(), localeContextKey, locale)
+	return r.WithContext(ctx)
+}
+
+// contextGetLocale doesn't panic when the locale is missing, because error responses
+// can be sent before the localize() middleware runs
+func (app *application) contextGetLocale(r *http.Request) string {
+	locale, ok := r.Context().Value(localeContextKey).(string)
+	if !ok {
+		return i18n.DefaultLocale
+	}
+
+	return locale
+}
+
+func (app *application) contextSetTimezone(r *http.Request, loc *time.Location) *http.Request {
+	ctx := context.WithValue(r.Context(), timezoneContextKey, loc)
+	return r.WithContext(ctx)
+}
+
+// contextGetTimezone returns the configured timezone when the request didn't ask for
+// one, or when the response is sent before the timezone() middleware runs. It's UTC
+// when the application was built without loading the config
+func (app *application) contextGetTimezone(r *http.Request) *time.Location {
+	loc, ok := r.Context().Value(timezoneContextKey).(*time.Location)
+	if !ok {
+		loc = app.config.timezoneLocation
+	}
+
+	if loc == nil {
+		return time.UTC
+	}
+
+	return loc
+}
+
+// permissionsCache holds the permissions of the request user once they have been
+// fetched, so stacked permission checks in the same request only query them once.
+// Since the context is per request, the cache never outlives the request.
+type permissionsCache struct {
+	loaded      bool
+	permissions data.Permissions
+}
+
+func (app *application) contextSetPermissionsCache(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, &permissionsCache{})
+	return r.WithContext(ctx)
+}
+
+// contextSetPermissions fills the permissions cache of the request, when the
+// permissions were already fetched along with the user
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) {
+	cache, ok := r.Context().Value(permissionsContextKey).(*permissionsCache)
+	if !ok {
+		return
+	}
+
+	cache.permissions = permissions
+	cache.loaded = true
+}
+
+// contextGetPermissions returns the permissions of the request user, fetching them
+// from the database only the first time they're needed in the request
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	cache, ok := r.Context().Value(permissionsContextKey).(*permissionsCache)
+	if !ok {
+		return app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	}
+
+	if !cache.loaded {
+		permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		cache.permissions = permissions
+		cache.loaded = true
+	}
+
+	return cache.permissions, nil
+}
+
+// clientAddr is the normalized address of the client. The port is empty when the IP
+// comes from a proxy header, because the port the proxy connected from isn't the
+// client one
+type clientAddr struct {
+	IP   string
+	Port string
+}
+
+func (app *application) contextSetClientAddr(r *http.Request, addr clientAddr) *http.Request {
+	ctx := context.WithValue(r.Context(), clientAddrContextKey, addr)
+	return r.WithContext(ctx)
+}
+
+// contextGetClientAddr falls back to the request remote address when the realIP()
+// middleware hasn't run yet
+func (app *application) contextGetClientAddr(r *http.Request) clientAddr {
+	addr, ok := r.Context().Value(clientAddrContextKey).(clientAddr)
+	if !ok {
+		return splitClientAddr(r.RemoteAddr)
+	}
+
+	return addr
+}
+
+func (app *application) contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns an empty string when the requestID() middleware
+// hasn't run
+func (app *application) contextGetRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
+
+func (app *application) contextSetScheme(r *http.Request, scheme string) *http.Request {
+	ctx := context.WithValue(r.Context(), schemeContextKey, scheme)
+	return r.WithContext(ctx)
+}
+
+// contextGetScheme returns the scheme the client used for the request, which is
+// only known from the connection when the forwarded() middleware hasn't run
+func (app *application) contextGetScheme(r *http.Request) string {
+	scheme, ok := r.Context().Value(schemeContextKey).(string)
+	if !ok {
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	}
+
+	return scheme
+}
+
+func (app *application) contextSetHost(r *http.Request, host string) *http.Request {
+	ctx := context.WithValue(r.Context(), hostContextKey, host)
+	return r.WithContext(ctx)
+}
+
+// contextGetHost returns the host the client used for the request, which is the Host
+// header when the forwarded() middleware hasn't run
+func (app *application) contextGetHost(r *http.Request) string {
+	host, ok := r.Context().Value(hostContextKey).(string)
+	if !ok {
+		return r.Host
+	}
+
+	return host
+}
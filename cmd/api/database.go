@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// warmupDB acquires n connections of the pool at the same time and releases them, so
+// the first requests after a cold start don't pay for establishing them. pgxpool also
+// opens the MinConns connections on its own, but in the background, while the server
+// may already be receiving requests
+func warmupDB(pool *pgxpool.Pool, n int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// each connection is held until the end, otherwise the next Acquire() would get
+	// it back instead of opening a new one
+	conns := make([]*pgxpool.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+
+	for range n {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	return nil
+}
+
+// dbHealth is the result of the periodic database health checks
+type dbHealth struct {
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// monitorDB pings the database every interval for the whole life of the process. A
+// failed ping is logged as an error along with the number of consecutive failures,
+// and the recovery once a ping succeeds again
+func monitorDB(pool *pgxpool.Pool, interval time.Duration, timeout time.Duration, logger *slog.Logger) *dbHealth {
+	health := &dbHealth{healthy: true}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := pool.Ping(ctx)
+			cancel()
+
+			health.record(err, logger)
+		}
+	}()
+
+	return health
+}
+
+func (h *dbHealth) record(err error, logger *slog.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastCheck = time.Now()
+
+	if err != nil {
+		h.healthy = false
+		h.failures++
+		h.lastError = err.Error()
+		logger.Error("database health check failed", "error", err.Error(), "consecutive_failures", h.failures)
+		return
+	}
+
+	if !h.healthy {
+		logger.Info("database health check recovered", "failed_checks", h.failures)
+	}
+
+	h.healthy = true
+	h.failures = 0
+	h.lastError = ""
+}
+
+// stats returns the state of the health checks for expvar
+func (h *dbHealth) stats() map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return map[string]any{
+		"healthy":              h.healthy,
+		"consecutive_failures": h.failures,
+		"last_check":           h.lastCheck.UTC().Format(time.RFC3339),
+		"last_error":           h.lastError,
+	}
+}
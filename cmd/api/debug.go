@@ -0,0 +1,76 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/mailer"
+)
+
+// sampleEmailToken is the token shown in the email previews, it looks like a real one
+// but it's never stored
+const sampleEmailToken = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+// sampleEmailData returns the data the email previews are rendered with, it has the
+// keys used by every template
+func (app *application) sampleEmailData() map[string]any {
+	return map[string]any{
+		"userID":           "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f80",
+		"activated":        false,
+		"activationToken":  sampleEmailToken,
+		"activationURL":    app.frontendURL(app.config.frontend.activationPath, sampleEmailToken),
+		"emailChangeToken": sampleEmailToken,
+		"emailChangeURL":   app.frontendURL(app.config.frontend.emailChangePath, sampleEmailToken),
+		"basePath":         app.config.basePath,
+	}
+}
+
+// previewEmailHandler renders an email template with sample data in the language of
+// the request and returns its HTML body, or its plain text body with format=plain,
+// without sending anything. The subject is sent in the X-Email-Subject header. The
+// route is only registered outside production
+func (app *application) previewEmailHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "template", "format")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	templateFile := app.readString(qs, "template", "")
+	format := app.readString(qs, "format", "html")
+
+	// only the names of the embedded templates are accepted, so the param can't be
+	// used to read any other file
+	v.Check(templateFile != "", "template", "must be provided")
+	v.Check(templateFile == "" || slices.Contains(mailer.Templates(), templateFile), "template", "must be the name of an email template")
+	v.Check(format == "html" || format == "plain", "format", "must be one of html or plain")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	email, err := app.mailer.Render(app.contextGetLocale(r), templateFile, app.sampleEmailData())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	body := email.HTMLBody
+	contentType := "text/html; charset=utf-8"
+	if format == "plain" {
+		body = email.PlainBody
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	// the subject may not be ASCII (e.g. in Spanish), which headers can't hold as is
+	w.Header().Set("X-Email-Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
@@ -1,23 +1,83 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		addr      = app.contextGetClientAddr(r)
+		requestID = app.contextGetRequestID(r)
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "client_ip", addr.IP, "client_port", addr.Port, "request_id", requestID)
+}
+
+// errorTypes holds the machine readable type of the error responses by status code
+var errorTypes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "edit_conflict",
+	http.StatusRequestURITooLong:   "uri_too_long",
+	http.StatusUnprocessableEntity: "validation_error",
+	http.StatusTooManyRequests:     "rate_limit_exceeded",
+	http.StatusInternalServerError: "server_error",
+	http.StatusServiceUnavailable:  "service_unavailable",
+	http.StatusGatewayTimeout:      "timeout",
+}
+
+// detailedMessage is a message along with the underlying error, which is sent in the
+// detail key
+type detailedMessage struct {
+	message string
+	detail  string
 }
 
+// errorResponse sends every error with the same shape:
+//
+//	{"error": {"status": 422, "type": "validation_error", "message": "...", "fields": {...}, "request_id": "..."}}
+//
+// where message is a string, or the validation errors of a validator, which are sent
+// in the fields key instead
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	errMapMsg := envelope{"error": message}
+	errType, ok := errorTypes[status]
+	if !ok {
+		errType = "error"
+	}
+
+	body := envelope{
+		"status":     status,
+		"type":       errType,
+		"request_id": app.contextGetRequestID(r),
+	}
 
-	err := app.writeJson(w, status, errMapMsg, nil)
+	// validation errors are already translated by the validator, so we only need
+	// to translate the plain string messages
+	switch msg := message.(type) {
+	case string:
+		body["message"] = app.translate(r, msg)
+	case validator.FieldErrors:
+		body["message"] = app.translate(r, "one or more fields are invalid")
+		body["fields"] = msg
+	case detailedMessage:
+		body["message"] = app.translate(r, msg.message)
+		body["detail"] = msg.detail
+	default:
+		body["message"] = msg
+	}
+
+	err := app.writeJson(w, r, status, envelope{"error": body}, nil)
 	if err != nil {
 		// fallback to internal server error
 		app.logError(r, err)
@@ -26,19 +86,75 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// the database is known to be down, so this isn't a bug in our code and we
+	// tell the client to try again once the circuit breaker cooldown is over
+	if errors.Is(err, data.ErrCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(app.config.db.breakerCooldown.Seconds())))
+		app.serviceUnavailableResponse(w, r)
+		return
+	}
+
+	// every connection of the pool is in use, the client can try again right away
+	if errors.Is(err, data.ErrPoolBusy) {
+		app.logger.Warn("database connection pool busy", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r))
+		app.serverBusyResponse(w, r)
+		return
+	}
+
+	// timeouts are usually caused by a slow or overloaded database rather than by a
+	// bug, so they are logged as warnings and reported with their own status code
+	if data.IsTimeoutError(err) {
+		addr := app.contextGetClientAddr(r)
+		app.logger.Warn("request timed out", "error", err.Error(), "method", r.Method, "uri", r.URL.RequestURI(), "client_ip", addr.IP, "client_port", addr.Port, "request_id", app.contextGetRequestID(r))
+		app.timeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
+
+	// the error may reveal internal details, so it's only sent while developing
+	if app.config.verboseErrors {
+		app.errorResponse(w, r, http.StatusInternalServerError, detailedMessage{message: message, detail: err.Error()})
+		return
+	}
+
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the service is temporarily unavailable, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) readOnlyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "service in read-only mode"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) serverBusyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is busy, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "request timed out, please try again later"
+	app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+}
+
+func (app *application) queryTooLongResponse(w http.ResponseWriter, r *http.Request, maxLength int) {
+	message := fmt.Sprintf(app.translate(r, "the query string must not be longer than %d bytes"), maxLength)
+	app.errorResponse(w, r, http.StatusRequestURITooLong, message)
+}
+
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s is not supported for this resource", r.Method)
+	message := fmt.Sprintf(app.translate(r, "the %s is not supported for this resource"), r.Method)
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
@@ -46,8 +162,8 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, v.FieldErrors())
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
@@ -89,3 +205,12 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) basicAuthRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	// The WWW-Authenticate header tells the client (or the monitoring tool) that it
+	// must authenticate using HTTP Basic Auth
+	w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+
+	message := "you must provide valid basic authentication credentials to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+)
+
+// fieldOrder returns the keys of the fields of a validation error response in the
+// order they were sent
+func fieldOrder(t *testing.T, res testResponse) []string {
+	t.Helper()
+
+	var body struct {
+		Error struct {
+			Fields json.RawMessage `json:"fields"`
+		} `json:"error"`
+	}
+	res.decode(t, &body)
+
+	dec := json.NewDecoder(bytes.NewReader(body.Error.Fields))
+
+	// skip the opening brace, then read the key and the message of each field
+	_, err := dec.Token()
+	if err != nil {
+		t.Fatalf("unable to read the fields %q: %v", body.Error.Fields, err)
+	}
+
+	var fields []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields = append(fields, key.(string))
+
+		_, err = dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return fields
+}
+
+func TestFailedValidationResponseOrder(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, data.Models{Users: testUsers("movies:write")}))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantFields []string
+	}{
+		{
+			name:       "register user",
+			method:     http.MethodPost,
+			path:       "/v1/users",
+			body:       `{"name":"","email":"not an email","password":"short"}`,
+			wantFields: []string{"name", "email", "password"},
+		},
+		{
+			name:       "create movie",
+			method:     http.MethodPost,
+			path:       "/v1/movies?validate_only=true",
+			token:      testToken,
+			body:       `{"title":"","year":1000,"runtime":"-1 mins","genres":[],"status":"unknown"}`,
+			wantFields: []string{"title", "year", "runtime", "genres", "status"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a map would be iterated in a different order from time to time, so
+			// the order is checked on several responses
+			for range 5 {
+				res := ts.do(t, tt.method, tt.path, tt.token, tt.body)
+				if res.status != http.StatusUnprocessableEntity {
+					t.Fatalf("got status %d, want %d: %s", res.status, http.StatusUnprocessableEntity, res.body)
+				}
+
+				if got := fieldOrder(t, res); !slices.Equal(got, tt.wantFields) {
+					t.Fatalf("got fields %v, want %v", got, tt.wantFields)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+// featureDefaults are the features which can be toggled at runtime, with the state
+// they have until an admin sets it. A new endpoint is dark launched by adding it here
+// disabled and wrapping its handler with requireFeature
+var featureDefaults = map[string]bool{
+	"movie_history": true,
+}
+
+// featureStates caches the states set by the admins, so checking a feature doesn't
+// query the database on every request. The states are reloaded once they are older
+// than the feature-flags-refresh setting
+type featureStates struct {
+	mu       sync.Mutex
+	flags    map[string]*data.FeatureFlag
+	loadedAt time.Time
+}
+
+// featureEnabled reports whether the feature is enabled. When the states can't be
+// loaded, the last known ones (or the defaults) are used until the next refresh
+func (app *application) featureEnabled(name string) bool {
+	app.features.mu.Lock()
+	defer app.features.mu.Unlock()
+
+	if time.Since(app.features.loadedAt) > app.config.featureFlagsRefresh {
+		flags, err := app.models.Features.GetAll()
+		if err != nil {
+			app.logger.Error("unable to load the feature flags", "error", err.Error())
+		} else {
+			app.features.flags = flags
+		}
+		app.features.loadedAt = time.Now()
+	}
+
+	if flag, ok := app.features.flags[name]; ok {
+		return flag.Enabled
+	}
+
+	return featureDefaults[name]
+}
+
+// requireFeature responds as if the route didn't exist while the feature is disabled
+func (app *application) requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.featureEnabled(name) {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// listFeaturesHandler returns the current state of every feature, read from the
+// database instead of the cache
+func (app *application) listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	flags, err := app.modelsFor(r).Features.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	features := []*data.FeatureFlag{}
+	for _, name := range slices.Sorted(maps.Keys(featureDefaults)) {
+		flag, ok := flags[name]
+		if !ok {
+			flag = &data.FeatureFlag{Name: name, Enabled: featureDefaults[name]}
+		}
+		features = append(features, flag)
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"features": features}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setFeatureHandler enables or disables a feature. The other instances of the API
+// pick up the change within feature-flags-refresh
+func (app *application) setFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	if _, ok := featureDefaults[name]; !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if v.Check(input.Enabled != nil, "enabled", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	flag := &data.FeatureFlag{Name: name, Enabled: *input.Enabled}
+
+	err = app.modelsFor(r).Features.Set(flag)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// this instance applies the change right away
+	app.features.mu.Lock()
+	app.features.loadedAt = time.Time{}
+	app.features.mu.Unlock()
+
+	app.recordAudit(r, app.requestActorID(r), data.AuditFeatureSet, name, map[string]any{"enabled": flag.Enabled})
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"feature": flag}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
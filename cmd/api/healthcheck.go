@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -13,7 +14,40 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		},
 	}
 
-	err := app.writeJson(w, http.StatusOK, data, nil)
+	// the mailer check is optional, because not every deployment sends emails. An
+	// unreachable SMTP server doesn't make the API unavailable, so it's only reported
+	// as degraded
+	if app.config.healthcheck.mailer {
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.timeout)
+		defer cancel()
+
+		mailerStatus := "up"
+
+		err := app.mailer.Ping(ctx)
+		if err != nil {
+			app.logger.Warn("mailer healthcheck failed", "error", err.Error())
+			mailerStatus = "down"
+			data["status"] = "degraded"
+		}
+
+		data["checks"] = map[string]string{"mailer": mailerStatus}
+	}
+
+	// the API is still available in read-only mode, but clients can tell why their
+	// writes fail
+	if app.readOnly.Load() {
+		data["read_only"] = true
+	}
+
+	// load balancers stop sending requests to a server which is shutting down, while
+	// the requests it's still handling are drained
+	status := http.StatusOK
+	if app.draining.Load() {
+		data["status"] = "draining"
+		status = http.StatusServiceUnavailable
+	}
+
+	err := app.writeJson(w, r, status, data, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
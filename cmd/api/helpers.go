@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,33 +12,59 @@ import (
 	"maps"
 	"net/http"
 	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/i18n"
+	"github.com/giancarlosisasi/greenlight-api/internal/schema"
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/jackc/pgx/v5"
 	"github.com/julienschmidt/httprouter"
 )
 
 type envelope map[string]any
 
+// readIDParam returns the id param of the route, which must be a UUID. The handlers
+// respond with a 404 when it isn't, without querying the database
 func (app *application) readIDParam(r *http.Request) (string, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
 	id := params.ByName("id")
-	if id == "" {
+	if id == "" || !validator.IsUUID(id) {
 		return "", errors.New("invalid id parameter")
 	}
 
 	return id, nil
 }
 
-func (app *application) writeJson(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// remember that in real hight traffic apps, its better to use json.Marshal() because it has better performance than MarshalIndent
-	js, err := json.MarshalIndent(data, "", "\t")
+func (app *application) writeJson(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	// time.Time values are marshalled in the timezone they were read in, which is UTC
+	var value any = data
+	if loc := app.contextGetTimezone(r); loc != time.UTC {
+		value = timesIn(reflect.ValueOf(data), loc).Interface()
+	}
+
+	js, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
+	// compact JSON is faster to produce and smaller, so the indented output is only
+	// used when -json-pretty is enabled
+	if app.config.jsonPretty {
+		var buf bytes.Buffer
+		err = json.Indent(&buf, js, "", "\t")
+		if err != nil {
+			return err
+		}
+		js = buf.Bytes()
+	}
+
 	js = append(js, '\n')
 
 	maps.Copy(w.Header(), headers)
@@ -46,9 +76,293 @@ func (app *application) writeJson(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// locations caches the timezones loaded by loadLocation(), as time.LoadLocation()
+// reads them from the disk every time
+var locations sync.Map
+
+// loadLocation returns the timezone with the given IANA name. Local and the empty
+// name, which time.LoadLocation() accepts, depend on the server so they are rejected
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// timeType is the type of the values converted by timesIn()
+var timeType = reflect.TypeFor[time.Time]()
+
+// timesIn returns a copy of v with every time.Time value in it converted to loc, so
+// they are encoded in that timezone. Only the time.Time values are changed, strings
+// which look like timestamps (e.g. in the changes of the audit log) are left as they
+// are. v isn't modified, the structs, slices and maps holding times are copied, as
+// they may be shared with other requests
+func timesIn(v reflect.Value, loc *time.Location) reflect.Value {
+	if !v.IsValid() || !mayHoldTime(v.Type()) {
+		return v
+	}
+
+	if v.Type() == timeType {
+		return reflect.ValueOf(v.Interface().(time.Time).In(loc))
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(timesIn(v.Elem(), loc))
+		return out
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(timesIn(v.Elem(), loc))
+		return out
+	case reflect.Struct:
+		// the unexported fields are copied as they are, they aren't encoded anyway
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				out.Field(i).Set(timesIn(v.Field(i), loc))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			out.Index(i).Set(timesIn(v.Index(i), loc))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := range v.Len() {
+			out.Index(i).Set(timesIn(v.Index(i), loc))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			out.SetMapIndex(iter.Key(), timesIn(iter.Value(), loc))
+		}
+		return out
+	}
+
+	return v
+}
+
+// timeHolders caches mayHoldTime() by type
+var timeHolders sync.Map
+
+// mayHoldTime reports whether the values of type t can hold a time.Time, so timesIn()
+// skips the values which can't without walking them
+func mayHoldTime(t reflect.Type) bool {
+	if holds, ok := timeHolders.Load(t); ok {
+		return holds.(bool)
+	}
+
+	holds := typeMayHoldTime(t, map[reflect.Type]bool{})
+	timeHolders.Store(t, holds)
+
+	return holds
+}
+
+func typeMayHoldTime(t reflect.Type, seen map[reflect.Type]bool) bool {
+	// a recursive type holds a time only if it does somewhere else than in itself
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return typeMayHoldTime(t.Elem(), seen)
+	case reflect.Struct:
+		if t == timeType {
+			return true
+		}
+		for i := range t.NumField() {
+			if t.Field(i).IsExported() && typeMayHoldTime(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// preferMinimal reports whether the request has the Prefer: return=minimal header of
+// RFC 7240, by which the client says it doesn't need the resource in the response
+func preferMinimal(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for preference := range strings.SplitSeq(value, ",") {
+			// the parameters of a preference come after a semicolon
+			preference, _, _ = strings.Cut(preference, ";")
+
+			name, val, _ := strings.Cut(preference, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "return") && strings.Trim(strings.TrimSpace(val), `"`) == "minimal" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// writeMinimal honors Prefer: return=minimal, it sends a 204 No Content response with
+// the given headers (the Location of the resource) instead of the resource
+func (app *application) writeMinimal(w http.ResponseWriter, headers http.Header) {
+	maps.Copy(w.Header(), headers)
+
+	w.Header().Set("Preference-Applied", "return=minimal")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// baseURL returns the scheme and host clients use to reach this server, without a
+// trailing slash. The public-url setting wins over whatever the request says, so
+// every URL is built the same way no matter how the API is reached
+func (app *application) baseURL(r *http.Request) string {
+	if app.config.publicURL != "" {
+		return app.config.publicURL
+	}
+
+	return app.contextGetScheme(r) + "://" + app.contextGetHost(r)
+}
+
+// absoluteURL returns the absolute URL of the given path in this server
+func (app *application) absoluteURL(r *http.Request, path string) string {
+	return app.baseURL(r) + path
+}
+
+// frontendURL returns the URL of the given page of the web app with the token as the
+// token query param, or an empty string when frontend-base-url isn't set
+func (app *application) frontendURL(path string, token string) string {
+	if app.config.frontend.baseURL == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(app.config.frontend.baseURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// redirect sends a redirect response to location, which is made absolute when it's a
+// path of this server. Handlers processing a form use http.StatusSeeOther, so the
+// client follows the redirect with a GET (the Post/Redirect/Get pattern)
+func (app *application) redirect(w http.ResponseWriter, r *http.Request, status int, location string) {
+	// like passing a bad destination to readJSON, this is a bug in the handler
+	if status < 300 || status > 399 {
+		panic(fmt.Sprintf("invalid redirect status %d", status))
+	}
+
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		location = app.absoluteURL(r, location)
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+}
+
+// seeOther redirects the client to location with a 303 See Other response
+func (app *application) seeOther(w http.ResponseWriter, r *http.Request, location string) {
+	app.redirect(w, r, http.StatusSeeOther, location)
+}
+
+// addVary adds the given header names to the Vary header of the response. Names that
+// are already present are skipped, so no matter how many middlewares vary on the same
+// header, caches always get a consistent list without duplicates.
+func (app *application) addVary(w http.ResponseWriter, headers ...string) {
+	present := make(map[string]bool)
+
+	for _, value := range w.Header().Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			present[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for _, header := range headers {
+		header = http.CanonicalHeaderKey(header)
+		if !present[header] {
+			w.Header().Add("Vary", header)
+			present[header] = true
+		}
+	}
+}
+
+// maxBodySize is the maximum size of the request bodies, once decompressed
+const maxBodySize = 1_048_576
+
+// decompressBody replaces the request body with a reader which decompresses it when
+// the client sent it with Content-Encoding gzip or deflate. The size limit is applied
+// to the decompressed body as well, so a small compressed body can't expand into a
+// huge one (a zip bomb). The Content-Encoding header is removed once it's handled, so
+// calling it again is a no-op
+func (app *application) decompressBody(w http.ResponseWriter, r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+
+	// the compressed body can't be larger than the decompressed one would be allowed
+	// to be either
+	compressed := http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	var body io.ReadCloser
+	var err error
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(compressed)
+	case "deflate":
+		body, err = zlib.NewReader(compressed)
+	default:
+		return fmt.Errorf(app.translate(r, "body has an unsupported Content-Encoding %q"), encoding)
+	}
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf(app.translate(r, "body must not be larger than %d bytes"), maxBytesError.Limit)
+		}
+		return fmt.Errorf(app.translate(r, "body is not valid %s data"), encoding)
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, compressed}
+	r.Header.Del("Content-Encoding")
+
+	return nil
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dest any) error {
+	err := app.decompressBody(w, r)
+	if err != nil {
+		return err
+	}
+
 	// Use http.MaxBytesReader() to limit the size of the request body to 1,048,576 bytes (1mb)
-	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 
 	// initialize the json.Decoder, and call the DisallowUnknownFields() method on it
 	// before decoding. THis means that if the JSOn from the client now includes any
@@ -58,7 +372,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dest an
 	dec.DisallowUnknownFields()
 
 	// decode the request body to the destination
-	err := dec.Decode(dest)
+	err = dec.Decode(dest)
 
 	if err != nil {
 		// If there is an error during decoding, start the triage
@@ -69,26 +383,26 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dest an
 
 		switch {
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at the character %d)", syntaxError.Offset)
+			return fmt.Errorf(app.translate(r, "body contains badly-formed JSON (at the character %d)"), syntaxError.Offset)
 		// in some circumstances Decode() may also return an io.ErrUnexpectedEOF error
 		// for syntax errors in the JSON. So we check for this using errors.Is() and
 		// return a generic error message.
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+			return errors.New(app.translate(r, "body contains badly-formed JSON"))
 		// Likewise, catch any json.UnmarshalTypeError errors. These occur when the
 		// JSON value is the wrong type ofr the target destination. If the error relates
 		// to a specific field, then we include in out error message to make it
 		// easier for client to debug
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+				return fmt.Errorf(app.translate(r, "body contains incorrect JSON type for field %q"), unmarshalTypeError.Field)
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+			return fmt.Errorf(app.translate(r, "body contains incorrect JSON type (at character %d)"), unmarshalTypeError.Offset)
 		// an io.EOF will be returned by Decode() if the request body is empty.
 		// We check for this with errors.Is() and return a plain-english error message
 		// instead
 		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+			return errors.New(app.translate(r, "body must not be empty"))
 
 		// if the json contains a field which cannot be mapped to the target destination
 		// then Decode() will now return an error message in the format "json: unknown field "<name>""
@@ -97,13 +411,13 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dest an
 		// into a distinct error type in the future
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown keys %s", fieldName)
+			return fmt.Errorf(app.translate(r, "body contains unknown keys %s"), fieldName)
 
 		// Use the errors.as() function to check whether the error has the type
 		// *http.MaxBytesErrors. If it does, then it means the request body exceed our size limit of 1mb
 		// and we return a clear error message
 		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+			return fmt.Errorf(app.translate(r, "body must not be larger than %d bytes"), maxBytesError.Limit)
 
 		// A json.InvalidUnmarshalError error will be returned if we pass something
 		// that is not a non-nil pointer as the target destination to Decode(). If this
@@ -124,7 +438,91 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dest an
 	// additional data in the request body and we return our own custom error message.
 	err = dec.Decode(&struct{}{})
 	if !errors.Is(err, io.EOF) {
-		return errors.New("body must only contain a single JSON value")
+		return errors.New(app.translate(r, "body must only contain a single JSON value"))
+	}
+
+	return nil
+}
+
+// readJSONWithSchema works like readJSON and, once the body has been decoded, also
+// validates it against the named JSON schema. The schema violations are added to v
+// keyed by the path of the field, so they are reported along with the ones found by
+// the handler
+func (app *application) readJSONWithSchema(w http.ResponseWriter, r *http.Request, schemaName string, dest any, v *validator.Validator) error {
+	// the schema is checked against the decompressed body
+	err := app.decompressBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, &body), r.Body}
+
+	err = app.readJSON(w, r, dest)
+	if err != nil {
+		return err
+	}
+
+	violations, err := schema.Validate(schemaName, body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// sorted, so the violations are always reported in the same order
+	for _, field := range slices.Sorted(maps.Keys(violations)) {
+		v.AddError(field, violations[field])
+	}
+
+	return nil
+}
+
+// modelsFor returns the models used to handle the request. With the db-tag-queries
+// setting their queries start with a comment which identifies the request
+func (app *application) modelsFor(r *http.Request) data.Models {
+	if app.taggedModels == nil {
+		return app.models
+	}
+
+	tag := fmt.Sprintf("request_id='%s',route='%s'",
+		url.QueryEscape(app.contextGetRequestID(r)),
+		url.QueryEscape(r.Method+" "+r.URL.Path),
+	)
+
+	return app.taggedModels(tag)
+}
+
+// newValidator returns a validator which translates its messages to the request locale
+func (app *application) newValidator(r *http.Request) *validator.Validator {
+	return validator.NewWithLocale(app.contextGetLocale(r))
+}
+
+// translate returns the message translated to the request locale
+func (app *application) translate(r *http.Request, message string) string {
+	return i18n.Translate(app.contextGetLocale(r), message)
+}
+
+// checkQueryParams returns an error listing the query params that aren't in allowed,
+// the same way readJSON rejects unknown fields. Unknown params are ignored unless the
+// strict-query-params setting is enabled
+func (app *application) checkQueryParams(r *http.Request, qs url.Values, allowed ...string) error {
+	if !app.config.strictQuery {
+		return nil
+	}
+
+	var unknown []string
+	for key := range qs {
+		// tz is accepted by every endpoint, see the timezone() middleware
+		if key != "tz" && !slices.Contains(allowed, key) {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf(app.translate(r, "unknown query parameters: %s"), strings.Join(unknown, ", "))
 	}
 
 	return nil
@@ -166,6 +564,22 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return intValue
 }
 
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	value := qs.Get(key)
+
+	if value == "" {
+		return defaultValue
+	}
+
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return boolValue
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 	// Launch a background goroutine
@@ -185,3 +599,99 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// modelsForTx returns the models which run their queries in the transaction tx
+func (app *application) modelsForTx(tx pgx.Tx) data.Models {
+	if app.txModels != nil {
+		return app.txModels(tx)
+	}
+
+	return data.NewModels(tx)
+}
+
+// withTx runs fn in a database transaction, which is committed when fn succeeds and
+// rolled back when it fails or panics. The models returned by app.modelsForTx(tx) run
+// their queries in the transaction. The queries in a transaction aren't retried, as
+// the failure of one of them aborts the whole transaction
+func (app *application) withTx(ctx context.Context, fn func(tx pgx.Tx) error) (err error) {
+	tx, err := app.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		pv := recover()
+		if pv == nil && err == nil {
+			return
+		}
+
+		// the rollback must happen even when the request has been canceled
+		rollbackErr := tx.Rollback(context.WithoutCancel(ctx))
+		if rollbackErr != nil && !errors.Is(rollbackErr, pgx.ErrTxClosed) {
+			app.logger.Error("unable to roll back the transaction", "error", rollbackErr.Error())
+		}
+
+		if pv != nil {
+			panic(pv)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// backgroundWithRetry runs fn in the background until it succeeds, at most attempts
+// times, waiting backoff before the second attempt and twice as long before each of
+// the next ones. A task that fails every attempt is recorded in the failed_tasks
+// table, so it can be inspected (and redone by hand) later. task describes it there
+// and must not contain secrets
+func (app *application) backgroundWithRetry(task string, fn func() error, attempts int, backoff time.Duration) {
+	app.background(func() {
+		var err error
+
+		for i := 1; i <= attempts; i++ {
+			err = fn()
+			if err == nil {
+				return
+			}
+
+			app.logger.Warn("background task failed", "task", task, "attempt", i, "error", err.Error())
+
+			if i < attempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+
+		failed := &data.FailedTask{
+			Task:     task,
+			Attempts: attempts,
+			Error:    err.Error(),
+		}
+
+		err = app.models.FailedTasks.Insert(failed)
+		if err != nil {
+			app.logger.Error("unable to record the failed background task", "task", task, "error", err.Error())
+		}
+	})
+}
+
+// sendEmail sends the email in the background with the retry policy of the config.
+// The task is named after the user ID and not after the recipient, and the address
+// is removed from the errors, so the logs and the failed_tasks table hold no email
+// addresses
+func (app *application) sendEmail(locale string, userID string, recipient string, templateFile string, templateData any) {
+	task := fmt.Sprintf("send %s email to user %s", templateFile, userID)
+
+	app.backgroundWithRetry(task, func() error {
+		err := app.mailer.Send(locale, recipient, templateFile, templateData)
+		if err != nil && recipient != "" && strings.Contains(err.Error(), recipient) {
+			return errors.New(strings.ReplaceAll(err.Error(), recipient, "[REDACTED]"))
+		}
+		return err
+	}, app.config.background.retryAttempts, app.config.background.retryBackoff)
+}
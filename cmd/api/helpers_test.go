@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/data/mocks"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestReadIDParam(t *testing.T) {
+	app := newTestApplication(t, data.Models{})
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{"valid", testMovieID, false},
+		{"empty", "", true},
+		{"malformed", "abc", true},
+		{"too short", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8", true},
+		{"not hexadecimal", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8g", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/movies/"+tt.id, nil)
+			ctx := context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: tt.id}})
+
+			id, err := app.readIDParam(r.WithContext(ctx))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && id != tt.id {
+				t.Errorf("got id %q, want %q", id, tt.id)
+			}
+		})
+	}
+}
+
+func TestWriteJSONTimezone(t *testing.T) {
+	app := newTestApplication(t, data.Models{})
+
+	lima, err := loadLocation("America/Lima")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	movie := &data.Movie{ID: testMovieID, CreatedAt: createdAt, Title: "Moana"}
+
+	// the timestamps written by the users are data, not times of the API
+	changes := map[string]any{"title": "2024-03-01T12:00:00Z", "released_at": "2024-03-01T12:00:00Z"}
+
+	entry := &data.AuditEntry{CreatedAt: createdAt, Changes: changes}
+
+	tests := []struct {
+		name          string
+		loc           *time.Location
+		wantCreatedAt string
+	}{
+		{"utc", time.UTC, "2024-03-01T12:00:00Z"},
+		{"lima", lima, "2024-03-01T07:00:00-05:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := app.contextSetTimezone(httptest.NewRequest("GET", "/v1/movies", nil), tt.loc)
+			w := httptest.NewRecorder()
+
+			err := app.writeJson(w, r, 200, envelope{"movies": []*data.Movie{movie}, "entry": entry, "expiry": createdAt}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var body struct {
+				Movies []struct {
+					CreatedAt string `json:"created_at"`
+				} `json:"movies"`
+				Entry struct {
+					CreatedAt string         `json:"created_at"`
+					Changes   map[string]any `json:"changes"`
+				} `json:"entry"`
+				Expiry string `json:"expiry"`
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, got := range map[string]string{"movie": body.Movies[0].CreatedAt, "entry": body.Entry.CreatedAt, "expiry": body.Expiry} {
+				if got != tt.wantCreatedAt {
+					t.Errorf("got %s time %q, want %q", name, got, tt.wantCreatedAt)
+				}
+			}
+
+			for key, value := range changes {
+				if body.Entry.Changes[key] != value {
+					t.Errorf("got change %s %q, want %q", key, body.Entry.Changes[key], value)
+				}
+			}
+
+			// the values shared with other requests aren't changed
+			if movie.CreatedAt.Location() != time.UTC || entry.CreatedAt.Location() != time.UTC {
+				t.Error("the times of the data were changed")
+			}
+		})
+	}
+}
+
+func TestCheckQueryParamsLocalized(t *testing.T) {
+	app := newTestApplication(t, data.Models{Movies: testMovies(), Users: testUsers("movies:read")})
+	app.config.strictQuery = true
+
+	ts := newTestServer(t, app)
+
+	tests := []struct {
+		language    string
+		wantMessage string
+	}{
+		{"en", "unknown query parameters: colour, size"},
+		{"es", "parámetros de consulta desconocidos: colour, size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/"+testMovieID+"/history?size=1&colour=red", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+testToken)
+			req.Header.Set("Accept-Language", tt.language)
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			var body struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			err = json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != http.StatusBadRequest || body.Error.Message != tt.wantMessage {
+				t.Errorf("got status %d and message %q, want %d and %q", res.StatusCode, body.Error.Message, http.StatusBadRequest, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSendEmailFailedTask(t *testing.T) {
+	var failed []*data.FailedTask
+
+	models := data.Models{
+		FailedTasks: &mocks.FailedTaskModel{
+			InsertFunc: func(task *data.FailedTask) error {
+				failed = append(failed, task)
+				return nil
+			},
+		},
+	}
+
+	app := newTestApplication(t, models)
+	app.config.background.retryAttempts = 2
+
+	mailer := newTestMailer()
+	mailer.err = errors.New("550 mailbox alice@example.com unavailable")
+	app.mailer = mailer
+
+	app.sendEmail("en", testUserID, "alice@example.com", "user_welcome.tmpl", nil)
+	app.wg.Wait()
+
+	if len(failed) != 1 {
+		t.Fatalf("got %d failed tasks, want 1", len(failed))
+	}
+
+	wantTask := "send user_welcome.tmpl email to user " + testUserID
+	if failed[0].Task != wantTask {
+		t.Errorf("got task %q, want %q", failed[0].Task, wantTask)
+	}
+
+	wantError := "550 mailbox [REDACTED] unavailable"
+	if failed[0].Error != wantError {
+		t.Errorf("got error %q, want %q", failed[0].Error, wantError)
+	}
+	if failed[0].Attempts != 2 {
+		t.Errorf("got %d attempts, want 2", failed[0].Attempts)
+	}
+}
@@ -3,51 +3,70 @@ package main
 import (
 	"context"
 	"expvar"
-	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
 	"runtime"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
 	"github.com/giancarlosisasi/greenlight-api/internal/mailer"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 )
 
 const version = "1.0.0"
 
-type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn string
-	}
+// emailSender is the part of *mailer.Mailer used by the handlers. Along with the
+// repositories of data.Models, it lets the application be built with fakes, so the
+// whole middleware chain of app.routes() can be exercised with httptest without a
+// database nor an SMTP server
+type emailSender interface {
+	Send(locale string, recipient string, templateFile string, data any) error
+	Render(locale string, templateFile string, data any) (*mailer.Email, error)
+	Ping(ctx context.Context) error
+}
 
-	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
-	}
-	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
-	}
+// txBeginner starts the transactions of app.withTx(), it's satisfied by *pgxpool.Pool
+type txBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
 type application struct {
 	config config
 	logger *slog.Logger
 	models data.Models
-	mailer *mailer.Mailer
+	db     txBeginner
+	mailer emailSender
 	wg     sync.WaitGroup
+	// onPanic, when set, is called in the background with every panic recovered
+	// while handling a request, e.g. to send an alert. ctx is the request context,
+	// which is still valid even though the response has already been sent
+	onPanic func(ctx context.Context, pv any)
+	// inFlight is the number of requests being handled right now
+	inFlight atomic.Int64
+	// draining is set once the graceful shutdown starts, the healthcheck reports the
+	// server as unavailable from then on
+	draining atomic.Bool
+	// features caches the states of the feature flags
+	features featureStates
+	// limiters are the rate limiters of the clients, nil when rate limiting is off
+	limiters *clientLimiters
+	// readOnly is set while the API only serves reads, it starts with the read-only
+	// setting and admins can toggle it with PUT /admin/read-only
+	readOnly atomic.Bool
+	// taggedModels, when set, returns the models with their queries tagged with the
+	// given comment, see modelsFor()
+	taggedModels func(tag string) data.Models
+	// txModels returns the models running their queries in the transaction of
+	// withTx(), data.NewModels(tx) when it's not set
+	txModels func(tx pgx.Tx) data.Models
+	// counters are the request metrics published in /debug/vars
+	counters requestCounters
 }
 
 func main() {
@@ -57,58 +76,43 @@ func main() {
 		log.Print("Error loading the .env file")
 	}
 
-	var cfg config
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	// get the default port value from env var
-	portStr := os.Getenv("PORT")
-	if portStr != "" {
-		portInt, err := strconv.Atoi(portStr)
-		if err != nil {
-			log.Fatal("Error to parse the port value")
-		}
-		cfg.port = portInt
-	} else {
-		flag.IntVar(&cfg.port, "port", 4000, "API server port")
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		logger.Error("invalid configuration", "error", err.Error())
+		os.Exit(1)
 	}
 
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-	flag.Parse()
+	logger.Info("effective configuration", effectiveConfig()...)
+	logger.Info("environment profile applied", profileAttrs(cfg)...)
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// the config has already been validated
+	data.SetPasswordHashAlgorithm(cfg.passwordHash)
+	data.SetAllowedGenres(cfg.genres)
+	data.SetTokenHashSecret(cfg.tokens.hashSecret, cfg.tokens.hashLegacy)
 
-	smtpPortStr := os.Getenv("SMTP_PORT")
-	smtpPort, err := strconv.Atoi(smtpPortStr)
-	if err != nil {
-		logger.Error(fmt.Sprintf("error to parse the smtp port, current value is: %s", smtpPortStr))
-		panic(fmt.Sprintf("SMTP Port is an invalid int value: %s", smtpPortStr))
-	}
 	// create the mailer
-	mailer := mailer.NewDialer(
-		os.Getenv("SMTP_HOST"),
-		smtpPort,
-		os.Getenv("SMTP_USERNAME"),
-		os.Getenv("SMTP_PASSWORD"),
-		os.Getenv("SMTP_SENDER"),
-	)
-
-	// rate limit default values
-	cfg.limiter.enabled = os.Getenv("LIMITER_ENABLED") == "true"
-	cfg.limiter.rps = 2
-	cfg.limiter.burst = 4
-	rps := os.Getenv("LIMITER_RPS")
-	rpsI, err := strconv.Atoi(rps)
-	if err == nil {
-		cfg.limiter.rps = float64(rpsI)
-	} else {
-		logger.Warn(fmt.Sprintf("> invalid integer value for env var %s", "LIMITER_RPS"))
-	}
-	burst := os.Getenv("LIMITER_BURST")
-	burstI, err := strconv.Atoi(burst)
-	if err == nil {
-		cfg.limiter.burst = burstI
-	} else {
-		logger.Warn(fmt.Sprintf("> invalid integer value for env var %s", "LIMITER_BURST"))
+	var mailerClient *mailer.Mailer
+	switch cfg.mailer.backend {
+	case "file":
+		mailerClient, err = mailer.NewFileMailer(cfg.mailer.dir, cfg.smtp.sender)
+		if err != nil {
+			logger.Error("unable to create the file mailer", "error", err.Error())
+			os.Exit(1)
+		}
+		logger.Info("emails are written to files instead of being sent", "dir", cfg.mailer.dir)
+	default:
+		mailerClient = mailer.NewDialer(
+			cfg.smtp.host,
+			cfg.smtp.port,
+			cfg.smtp.username,
+			cfg.smtp.password,
+			cfg.smtp.sender,
+			cfg.smtp.concurrency,
+		)
 	}
+	mailerClient.MaxBodySize = cfg.smtp.maxBodySize
 
 	db, err := openDB(cfg)
 	if err != nil {
@@ -120,6 +124,17 @@ func main() {
 	defer db.Close()
 	logger.Info("database connection pool established!")
 
+	// a failed warmup isn't fatal, the connections are opened on demand anyway
+	if cfg.db.warmup {
+		start := time.Now()
+		err = warmupDB(db, cfg.db.minConns, 10*time.Second)
+		if err != nil {
+			logger.Warn("unable to warm up the database connection pool", "error", err.Error())
+		} else {
+			logger.Info("database connection pool warmed up", "conns", cfg.db.minConns, "duration", time.Since(start))
+		}
+	}
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
 		return runtime.NumGoroutine()
@@ -138,18 +153,93 @@ func main() {
 			"new_conns_count":            stats.NewConnsCount(),
 			"max_lifetime_destroy_count": stats.MaxLifetimeDestroyCount(),
 			"max_idle_destroy_count":     stats.MaxIdleDestroyCount(),
+			"acquire_duration_ms":        stats.AcquireDuration().Milliseconds(),
 		}
 	}))
 
+	if cfg.db.healthCheckInterval > 0 {
+		health := monitorDB(db, cfg.db.healthCheckInterval, cfg.healthcheck.timeout, logger)
+		expvar.Publish("database_health", expvar.Func(func() any {
+			return health.stats()
+		}))
+	}
+
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	// The acquire timeout applies to each attempt made by the retries, the slow query
+	// logger measures every attempt as well, and the breaker
+	// wraps the retries so a query only counts as a failure once all of its attempts
+	// have failed
+	var modelsDB data.DB = db
+	if cfg.db.acquireTimeout > 0 {
+		acquirer := data.NewAcquireTimeoutDB(db, cfg.db.acquireTimeout)
+		expvar.Publish("database_pool_wait", expvar.Func(func() any {
+			acquires, timeouts, waitTime := acquirer.Stats()
+			return map[string]any{
+				"acquires":     acquires,
+				"timeouts":     timeouts,
+				"wait_time_ms": waitTime.Milliseconds(),
+			}
+		}))
+		modelsDB = acquirer
+	}
+	if cfg.db.slowQueryThreshold > 0 {
+		modelsDB = data.NewSlowQueryDB(modelsDB, cfg.db.slowQueryThreshold, logger)
+	}
+	modelsDB = data.NewRetryDB(modelsDB, cfg.db.retryAttempts, cfg.db.retryBackoff)
+	if cfg.db.breakerThreshold > 0 {
+		breaker := data.NewBreakerDB(modelsDB, cfg.db.breakerThreshold, cfg.db.breakerCooldown)
+		expvar.Publish("database_circuit_breaker", expvar.Func(func() any {
+			return breaker.State()
+		}))
+		modelsDB = breaker
+	}
+
+	movies := data.NewMovieModel(modelsDB)
+	movies.UniqueTitleYear = cfg.uniqueMovies
+
+	if cfg.movieCache.size > 0 {
+		movies.EnableCache(cfg.movieCache.size, cfg.movieCache.ttl)
+	}
+
+	expvar.Publish("movie_cache", expvar.Func(func() any {
+		hits, misses, size := movies.CacheStats()
+		return map[string]any{
+			"hits":   hits,
+			"misses": misses,
+			"size":   size,
+		}
+	}))
+
+	models := data.NewModels(modelsDB)
+	models.Movies = movies
+
 	app := application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer,
+		models: models,
+		db:     db,
+		mailer: mailerClient,
+	}
+
+	app.readOnly.Store(cfg.readOnly)
+
+	app.counters.publish()
+	expvar.Publish("in_flight_requests", expvar.Func(func() any {
+		return app.inFlight.Load()
+	}))
+
+	if cfg.db.tagQueries {
+		app.taggedModels = func(tag string) data.Models {
+			taggedDB := data.NewQueryTagDB(modelsDB, tag)
+
+			tagged := data.NewModels(taggedDB)
+			tagged.Movies = movies.WithDB(taggedDB)
+
+			return tagged
+		}
 	}
 
 	err = app.serve()
@@ -161,15 +251,15 @@ func main() {
 }
 
 func openDB(cfg config) (*pgxpool.Pool, error) {
-	databaseUrl := os.Getenv("DATABASE_URL")
-	pgxConfig, err := pgxpool.ParseConfig(databaseUrl)
+	pgxConfig, err := pgxpool.ParseConfig(cfg.db.dsn)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "unable to parse database url configuration: %v\n", err)
 		return nil, err
 	}
 
-	pgxConfig.MaxConns = 30
-	pgxConfig.MaxConnIdleTime = time.Minute * 15
+	pgxConfig.MaxConns = int32(cfg.db.maxConns)
+	pgxConfig.MinConns = int32(cfg.db.minConns)
+	pgxConfig.MaxConnIdleTime = cfg.db.maxIdleTime
 
 	dbpool, err := pgxpool.NewWithConfig(context.Background(), pgxConfig)
 	if err != nil {
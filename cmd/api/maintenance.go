@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+)
+
+// setReadOnlyHandler turns the read-only mode on or off. The mode only lives in the
+// memory of this instance, so it's lost on restart and every instance behind a load
+// balancer has to be toggled. It doesn't depend on the database, which may be the one
+// under maintenance
+func (app *application) setReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if v.Check(input.Enabled != nil, "enabled", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	app.readOnly.Store(*input.Enabled)
+
+	app.logger.Warn("read-only mode toggled", "enabled", *input.Enabled, "request_id", app.contextGetRequestID(r))
+	// the audit entry can't be recorded when the database is read only, which is
+	// logged and doesn't fail the request
+	app.recordAudit(r, app.requestActorID(r), data.AuditReadOnlySet, "", map[string]any{"enabled": *input.Enabled})
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"read_only": *input.Enabled}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
-	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/giancarlosisasi/greenlight-api/internal/i18n"
 	"golang.org/x/time/rate"
 )
 
@@ -38,6 +50,15 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				// error at the ERROR level and send the client a 500 Internal
 				// Server Error response
 				app.serverErrorResponse(w, r, fmt.Errorf("%v", pv))
+
+				// the hook runs once the response is sent, so a slow alerting
+				// service doesn't delay it
+				if app.onPanic != nil {
+					ctx := context.WithoutCancel(r.Context())
+					app.background(func() {
+						app.onPanic(ctx, pv)
+					})
+				}
 			}
 		}()
 
@@ -45,78 +66,333 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	if !app.config.limiter.enabled {
+func (app *application) localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response language depends on the Accept-Language header
+		app.addVary(w, "Accept-Language")
+
+		locale := i18n.MatchAcceptLanguage(r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", locale)
+
+		r = app.contextSetLocale(r, locale)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitConcurrency sheds the requests over the server-max-concurrent limit with a 503,
+// after letting them wait up to server-concurrency-wait for one of the requests being
+// handled to finish. The healthcheck is never shed, so load balancers don't take an
+// overloaded but working server out of rotation
+func (app *application) limitConcurrency(next http.Handler) http.Handler {
+	limit := app.config.server.maxConcurrent
+	if limit == 0 {
 		return next
 	}
 
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+	slots := make(chan struct{}, limit)
+	wait := app.config.server.concurrencyWait
+	healthcheck := app.apiPath("/healthcheck")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthcheck {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		acquired := false
+		select {
+		case slots <- struct{}{}:
+			acquired = true
+		default:
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case slots <- struct{}{}:
+					acquired = true
+				case <-timer.C:
+				case <-r.Context().Done():
+				}
+				timer.Stop()
+			}
+		}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+		if !acquired {
+			app.counters.shed.Add(1)
+			// spikes are short, so the client can try again soon
+			w.Header().Set("Retry-After", "1")
+			app.serverBusyResponse(w, r)
+			return
+		}
+		defer func() { <-slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyMode rejects the requests which may change data while the API is in
+// read-only mode, the reads keep working. Turning the mode off is always allowed
+func (app *application) readOnlyMode(next http.Handler) http.Handler {
+	toggle := app.apiPath("/admin/read-only")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if app.readOnly.Load() && r.URL.Path != toggle {
+				app.readOnlyResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
+// timezone sets the timezone of the timestamps in the response, taken from the tz
+// query param or else from the X-Timezone header
+func (app *application) timezone(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.addVary(w, "X-Timezone")
+
+		name := r.URL.Query().Get("tz")
+		if name == "" {
+			name = r.Header.Get("X-Timezone")
+		}
+
+		if name != "" {
+			loc, err := loadLocation(name)
+			if err != nil {
+				app.badRequestResponse(w, r, fmt.Errorf(app.translate(r, "unknown timezone %q"), name))
+				return
+			}
+
+			r = app.contextSetTimezone(r, loc)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config.securityHeaders
+
+		if cfg.noSniff {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+
+		if cfg.frameOptions != "" {
+			w.Header().Set("X-Frame-Options", cfg.frameOptions)
+		}
+
+		if cfg.referrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", cfg.referrerPolicy)
+		}
+
+		// The Strict-Transport-Security header is ignored by browsers when it's sent
+		// over plain HTTP, so we only set it when the client used HTTPS (even if the
+		// TLS connection was terminated by a trusted proxy)
+		if app.contextGetScheme(r) == "https" && cfg.hstsMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", cfg.hstsMaxAge))
+		}
+
+		// Override the Server header when it's configured, otherwise make sure we
+		// don't advertise anything about the server
+		if cfg.server != "" {
+			w.Header().Set("Server", cfg.server)
+		} else {
+			w.Header().Del("Server")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientLimiters holds a token bucket rate limiter per client key (usually the client IP)
+type clientLimiters struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+	rps     rate.Limit
+	burst   int
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiters(rps rate.Limit, burst int) *clientLimiters {
+	cl := &clientLimiters{
+		clients: make(map[string]*clientLimiter),
+		rps:     rps,
+		burst:   burst,
+	}
+
+	// remove the clients that haven't been seen recently
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 
-			mu.Lock()
+			cl.mu.Lock()
 
-			for ip, client := range clients {
+			for key, client := range cl.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(cl.clients, key)
 				}
 			}
 
-			mu.Unlock()
+			cl.mu.Unlock()
 		}
 	}()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
+	return cl
+}
 
-		mu.Lock()
+func (cl *clientLimiters) allow(key string) bool {
+	allowed, _ := cl.allowWith(key, cl.rps, cl.burst)
+	return allowed
+}
 
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				),
-			}
+// allowWith works like allow, but with the given limits instead of the default ones,
+// and it also returns the number of requests the client can still make right away.
+// The limits of a known client are updated when they change
+func (cl *clientLimiters) allowWith(key string, rps rate.Limit, burst int) (bool, float64) {
+	// The mutex is only held while checking the limiter, never while the handlers
+	// downstream of the middlewares using this method are running
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	client, found := cl.clients[key]
+	if !found {
+		client = &clientLimiter{
+			limiter: rate.NewLimiter(rps, burst),
 		}
+		cl.clients[key] = client
+	} else if client.limiter.Limit() != rps || client.limiter.Burst() != burst {
+		client.limiter.SetLimit(rps)
+		client.limiter.SetBurst(burst)
+	}
+
+	client.lastSeen = time.Now()
+
+	allowed := client.limiter.Allow()
+
+	return allowed, client.limiter.Tokens()
+}
+
+// state returns the number of requests the client can make right away and how long
+// until its bucket is full again, without using any of them. An unknown client has a
+// full bucket
+func (cl *clientLimiters) state(key string, rps rate.Limit, burst int) (float64, time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	client, found := cl.clients[key]
+	if !found {
+		return float64(burst), 0
+	}
+
+	// the limits may have been lowered since the client was last seen
+	tokens := min(client.limiter.Tokens(), float64(burst))
+	if tokens >= float64(burst) || rps <= 0 {
+		return max(tokens, 0), 0
+	}
 
-		clients[ip].lastSeen = time.Now()
+	refill := time.Duration((float64(burst) - tokens) / float64(rps) * float64(time.Second))
 
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
+	return max(tokens, 0), refill
+}
+
+// rateLimitKey returns the key used to rate limit the request. Requests made with an
+// API key are limited per key, no matter where they come from, and requests of users
+// with their own rate limit are limited per user. The rest are limited per client IP
+// (without the port, since every connection of a client uses a different one)
+func rateLimitKey(ip string, user *data.User, r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && data.IsAPIKey(token) {
+		hash := sha256.Sum256([]byte(token))
+		return "api-key:" + hex.EncodeToString(hash[:])
+	}
+
+	if user.RateLimit != nil {
+		return "user:" + user.ID
+	}
+
+	return ip
+}
+
+// rateLimitFor returns the key the request is rate limited with and its limits: the
+// ones of the user when it has its own rate limit, the global ones otherwise
+func (app *application) rateLimitFor(r *http.Request) (string, rate.Limit, int) {
+	user := app.contextGetUser(r)
+	key := rateLimitKey(app.contextGetClientAddr(r).IP, user, r)
+
+	if user.RateLimit != nil {
+		return key, rate.Limit(user.RateLimit.RPS), user.RateLimit.Burst
+	}
+
+	return key, rate.Limit(app.config.limiter.rps), app.config.limiter.burst
+}
+
+// rateLimit runs after authenticate(), so the users with their own rate limit (which
+// is loaded along with them) get it instead of the global one. The limiters are kept
+// in app.limiters, so GET /ratelimit can report the state of the client
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+
+	app.limiters = newClientLimiters(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)
+	limiters := app.limiters
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, rps, burst := app.rateLimitFor(r)
+
+		allowed, remaining := limiters.allowWith(key, rps, burst)
+		if !allowed {
 			app.rateLimitExceedResponse(w, r)
 			return
 		}
 
-		// Very importantly, unlock the mutex before calling the next handler in the chain.
-		// Notice that we DON'T use defer to unlock the mutex, as that would mean
-		// that the mutex isn't unlocked until all the handlers downstream of this
-		// middleware have also returned
-		mu.Unlock()
+		// the client is still allowed, but it's close to the limit, so a well-behaved
+		// client can slow down before getting 429 responses
+		if remaining < app.config.limiter.warningThreshold*float64(burst) {
+			w.Header().Set("X-RateLimit-Warning", "approaching limit")
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *application) rateLimitRoute(rps rate.Limit, burst int, next http.HandlerFunc) http.HandlerFunc {
+	limiters := newClientLimiters(rps, burst)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiters.allow(app.contextGetClientAddr(r).IP) {
+			app.rateLimitExceedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
 var trueClientIP = http.CanonicalHeaderKey("True-Client-IP")
 var xForwardedFor = http.CanonicalHeaderKey("X-Forward-For")
 var xRealIP = http.CanonicalHeaderKey("X-Real-IP")
 
 func (app *application) realIP(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		addr := splitClientAddr(r.RemoteAddr)
+
 		if rip := getRealIP(r); rip != "" {
 			r.RemoteAddr = rip
+			addr = clientAddr{IP: rip}
 		}
+
+		r = app.contextSetClientAddr(r, addr)
+
 		next.ServeHTTP(w, r)
 	}
 
@@ -141,18 +417,207 @@ func getRealIP(r *http.Request) string {
 	return ip
 }
 
+// forwarded works out the scheme and host used by the client. Behind a TLS terminating
+// proxy or a gateway the connection doesn't tell them, so the X-Forwarded-Proto and
+// X-Forwarded-Host headers are used instead, but only when the request comes from one
+// of the trusted proxies
+func (app *application) forwarded(next http.Handler) http.Handler {
+	// the config has already been validated
+	proxies, _ := parseTrustedProxies(app.config.trustedProxies)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		host := r.Host
+
+		if isTrustedProxy(proxies, r.RemoteAddr) {
+			proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+			if r.TLS == nil && (proto == "http" || proto == "https") {
+				scheme = proto
+			}
+
+			// with several proxies in front the header is a list, the first one is
+			// the host the client asked for
+			forwardedHost, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+			forwardedHost = strings.TrimSpace(forwardedHost)
+			if validHost(forwardedHost) {
+				host = forwardedHost
+			}
+		}
+
+		r = app.contextSetScheme(r, scheme)
+		r = app.contextSetHost(r, host)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validHost reports whether host is a host name or IP, with an optional port, so it
+// can't be used to inject anything else in the URLs built with it
+func validHost(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+
+	u, err := url.Parse("http://" + host)
+	return err == nil && u.Host == host && u.User == nil
+}
+
+func isTrustedProxy(proxies []netip.Prefix, remoteAddr string) bool {
+	addr, err := netip.ParseAddr(splitClientAddr(remoteAddr).IP)
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(proxies, func(proxy netip.Prefix) bool {
+		return proxy.Contains(addr.Unmap())
+	})
+}
+
+// requestID gives every request an ID, sent back in the X-Request-ID header and
+// included in the error responses and logs. The ID sent by the client (or by a proxy)
+// is kept when it's reasonable, so requests can be traced across services
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = rand.Text()
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		r = app.contextSetRequestID(r, requestID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID only accepts short IDs made of letters, digits, dashes and
+// underscores, so client provided values can be safely logged
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// limitQuery rejects the requests with a query string longer or with more params
+// than the configured maximums. It only looks at the raw query, so pathological
+// query strings are rejected before anything parses them
+func (app *application) limitQuery(next http.Handler) http.Handler {
+	maxLength := app.config.server.maxQueryLength
+	maxParams := app.config.server.maxQueryParams
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxLength > 0 && len(r.URL.RawQuery) > maxLength {
+			app.queryTooLongResponse(w, r, maxLength)
+			return
+		}
+
+		if maxParams > 0 && r.URL.RawQuery != "" && strings.Count(r.URL.RawQuery, "&")+1 > maxParams {
+			app.badRequestResponse(w, r, fmt.Errorf(app.translate(r, "the query string must not contain more than %d parameters"), maxParams))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headRequests answers HEAD requests with the GET handler of the route. The body
+// written by the handler is discarded, but its length is still sent in the
+// Content-Length header, so the headers are the same than for a GET request
+func (app *application) headRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+
+		hw := &headResponseWriter{wrapped: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(hw, r)
+
+		if w.Header().Get("Content-Length") == "" && hw.statusCode != http.StatusNoContent && hw.statusCode != http.StatusNotModified {
+			w.Header().Set("Content-Length", strconv.Itoa(hw.contentLength))
+		}
+		w.WriteHeader(hw.statusCode)
+	})
+}
+
+// headResponseWriter holds the status code until the handler is done and counts
+// the body bytes instead of writing them
+type headResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+	contentLength int
+}
+
+func (hw *headResponseWriter) Header() http.Header {
+	return hw.wrapped.Header()
+}
+
+func (hw *headResponseWriter) WriteHeader(statusCode int) {
+	if !hw.headerWritten {
+		hw.statusCode = statusCode
+		hw.headerWritten = true
+	}
+}
+
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	hw.headerWritten = true
+	hw.contentLength += len(b)
+	return len(b), nil
+}
+
+// splitClientAddr splits an address like "203.0.113.7:52100", "[2001:db8::1]:52100"
+// or a bare IP into its normalized IP and its port, which is empty when the address
+// doesn't have one
+func splitClientAddr(addr string) clientAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		port = ""
+	}
+
+	// normalize the IP, so for example IPv4-mapped IPv6 addresses are keyed like
+	// their IPv4 version
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	return clientAddr{IP: host, Port: port}
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the Vary: Authorization header to the response.
 		// This indicates to any caches that the response may vary based on the value of
 		// the Authorization header in the request
-		w.Header().Add("Vary", "Authorization")
+		app.addVary(w, "Authorization")
+
+		// Every request gets an empty permissions cache, which is filled the first
+		// time the permissions of the user are checked
+		r = app.contextSetPermissionsCache(r)
 
 		// Retrieve the value of the Authorization header from the request.
 		// This will return the empty string "" if there is not such header found.
 		authorizationHeader := r.Header.Get("Authorization")
 
-		if authorizationHeader == "" {
+		// Basic credentials are checked by the requireBasicAuth() middleware on the
+		// routes that allow it, so at this point the request is anonymous
+		if authorizationHeader == "" || strings.HasPrefix(authorizationHeader, "Basic ") {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
@@ -170,14 +635,36 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
-		v := validator.New()
+		// API keys have their own permissions instead of the ones of their owner
+		if data.IsAPIKey(token) {
+			user, permissions, err := app.modelsFor(r).APIKeys.GetOwnerForKey(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			app.contextSetPermissions(r, permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := app.newValidator(r)
 
 		if data.ValidateTokenPlainText(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		// the permissions are fetched along with the user, so the permission checks
+		// of the route don't need another query
+		user, permissions, authToken, err := app.modelsFor(r).Users.GetForTokenWithPermissions(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -189,11 +676,39 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		r = app.contextSetUser(r, user)
+		app.contextSetPermissions(r, permissions)
+
+		if app.config.tokens.slidingWindow > 0 {
+			app.extendTokenExpiry(r, authToken)
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// extendTokenExpiry implements sliding sessions: the token expires once it hasn't
+// been used for the sliding window, but never later than the max lifetime since it
+// was created. To avoid a write on every request, the expiry is only updated when
+// it moves forward by at least a minute. A failure doesn't fail the request, the
+// token is still valid
+func (app *application) extendTokenExpiry(r *http.Request, token *data.Token) {
+	expiry := time.Now().Add(app.config.tokens.slidingWindow)
+
+	maxExpiry := token.CreatedAt.Add(app.config.tokens.maxLifetime)
+	if expiry.After(maxExpiry) {
+		expiry = maxExpiry
+	}
+
+	if expiry.Sub(token.Expiry) < time.Minute {
+		return
+	}
+
+	err := app.modelsFor(r).Tokens.ExtendExpiry(token.Hash, expiry)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -224,9 +739,7 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 func (app *application) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.contextGetPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -243,15 +756,99 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 	return app.requireActivatedUser(fn)
 }
 
-func (app *application) enableCORS(next http.Handler) http.Handler {
-	trustedOrigins := []string{
-		"http://localhost:9000",
-		"http://localhost:9002",
+func (app *application) requireBasicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !app.basicAuthMatches(username, password) {
+			app.basicAuthRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
 	}
+}
+
+// requireBasicAuthOrPermissions allows a route to be accessed either with basic auth
+// credentials (when they are configured) or with a bearer token of a user that has
+// the given permission code. When basic auth is configured, the requests without
+// either get the basic auth challenge, so browsers and curl ask for the credentials
+func (app *application) requireBasicAuthOrPermissions(code string, next http.HandlerFunc) http.HandlerFunc {
+	withBasicAuth := app.requireBasicAuth(next)
+	withPermissions := app.requirePermissions(code, next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _, hasBasicAuth := r.BasicAuth()
+
+		if app.config.basicAuth.username == "" {
+			// basic credentials can't be checked, they are wrong rather than anonymous
+			if hasBasicAuth {
+				app.invalidCredentialsResponse(w, r)
+				return
+			}
+
+			withPermissions(w, r)
+			return
+		}
+
+		if hasBasicAuth {
+			withBasicAuth(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() || !user.Activated {
+			app.basicAuthRequiredResponse(w, r)
+			return
+		}
+
+		permissions, err := app.contextGetPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.basicAuthRequiredResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (app *application) basicAuthMatches(username, password string) bool {
+	if app.config.basicAuth.username == "" {
+		return false
+	}
+
+	// Hash both values before comparing them so that ConstantTimeCompare() always
+	// works with slices of the same length and we don't leak the length of the
+	// expected credentials through the response time
+	usernameHash := sha256.Sum256([]byte(username))
+	passwordHash := sha256.Sum256([]byte(password))
+	expectedUsernameHash := sha256.Sum256([]byte(app.config.basicAuth.username))
+	expectedPasswordHash := sha256.Sum256([]byte(app.config.basicAuth.password))
+
+	usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1
+	passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1
+
+	return usernameMatch && passwordMatch
+}
+
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	cfg := app.config.cors
+
+	// "*" allows any origin. It's rejected by the config validation when credentials
+	// are enabled, because browsers refuse credentialed responses with a wildcard origin
+	allowAnyOrigin := slices.Contains(cfg.trustedOrigins, "*")
+	allowedMethods := strings.Join(cfg.allowedMethods, ", ")
+	allowedHeaders := strings.Join(cfg.allowedHeaders, ", ")
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Vary", "Origin")
-		w.Header().Add("Vary", "Access-Control-Request-Method")
+		// These Vary headers must be set on every response, not only on the ones to
+		// trusted origins, otherwise a cache could serve a response without the CORS
+		// headers to a trusted origin (or the other way around)
+		app.addVary(w, "Origin", "Access-Control-Request-Method")
 
 		origin := r.Header.Get("Origin")
 
@@ -260,16 +857,28 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			return
 		}
 
-		if slices.Contains(trustedOrigins, origin) {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
+		if allowAnyOrigin || slices.Contains(cfg.trustedOrigins, origin) {
+			if allowAnyOrigin && !cfg.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if cfg.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
 
 			// CHeck if the request hast the HTTP method OPTIONS and contains the
 			// "Access-Control-Request-Method" header. If it does, then we treat
 			// it as a preflight request.
 			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 				// Set the necessary preflight response headers
-				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+
+				if cfg.maxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.maxAge.Seconds())))
+				}
 
 				// write the headers along with a 200 ok status and return from
 				// the middleware with no further action
@@ -319,34 +928,247 @@ func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
 	return mw.wrapped
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	var (
-		totalRequestsReceived           = expvar.NewInt("total_requests_received")
-		totalResponsesSent              = expvar.NewInt("total_responses_sent")
-		totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
-		totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
-	)
+// requestCounters are the request metrics published by main() in /debug/vars. They are
+// kept in the application instead of being registered by the middlewares, because
+// expvar panics when a name is registered twice and routes() may be built more than
+// once, e.g. by the tests
+type requestCounters struct {
+	received                   expvar.Int
+	sent                       expvar.Int
+	processingTimeMicroseconds expvar.Int
+	sentByStatus               expvar.Map
+	// shed is the number of requests rejected by limitConcurrency()
+	shed expvar.Int
+}
+
+// publish registers the counters in expvar, it must be called only once
+func (c *requestCounters) publish() {
+	expvar.Publish("total_requests_received", &c.received)
+	expvar.Publish("total_responses_sent", &c.sent)
+	expvar.Publish("total_processing_time_μs", &c.processingTimeMicroseconds)
+	expvar.Publish("total_responses_sent_by_status", &c.sentByStatus)
+	expvar.Publish("shed_requests", &c.shed)
+}
 
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		totalRequestsReceived.Add(1)
+		app.counters.received.Add(1)
+
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
 
 		mw := newMetricsResponseWriter(w)
 
 		next.ServeHTTP(mw, r)
 
-		totalResponsesSent.Add(1)
+		app.counters.sent.Add(1)
 
 		// at this point, the response status code should be stored in th
 		// mw.statusCode field. Note that the expvar map is string-keyed, so we
 		// need to use the strconv.Itoa() function to convert the status code
 		// (which is an integer) to a string. Then we use the Add() method on
-		// our new totalResponsesSentByStatus map to increment the count for the
-		// given status code by 1
-		totalResponsesSentByStatus.Add(strconv.Itoa(mw.statusCode), 1)
+		// the sentByStatus map to increment the count for the given status code by 1
+		app.counters.sentByStatus.Add(strconv.Itoa(mw.statusCode), 1)
 
 		duration := time.Since(start).Microseconds()
-		totalProcessingTimeMicroseconds.Add(duration)
+		app.counters.processingTimeMicroseconds.Add(duration)
+	})
+}
+
+// logRequest logs every request once it has been handled. The successful requests
+// are sampled: with a rate of N only the first of every N requests is logged, counted
+// separately for each of the sample routes and for the rest of the requests
+func (app *application) logRequest(next http.Handler) http.Handler {
+	cfg := app.config.requestLog
+	if !cfg.enabled {
+		return next
+	}
+
+	routes, _ := parseSampleRoutes(cfg.sampleRoutes)
+	counters := make([]atomic.Uint64, len(routes))
+	var defaultCounter atomic.Uint64
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mw, r)
+
+		duration := time.Since(start)
+
+		rate, counter := cfg.sampleRate, &defaultCounter
+		for i, route := range routes {
+			if route.matches(r.Method, r.URL.Path) {
+				rate, counter = route.rate, &counters[i]
+				break
+			}
+		}
+
+		successful := mw.statusCode >= 200 && mw.statusCode < 300
+		slow := cfg.slowThreshold > 0 && duration >= cfg.slowThreshold
+
+		if successful && !slow && rate > 1 && (counter.Add(1)-1)%uint64(rate) != 0 {
+			return
+		}
+
+		// the port is empty when the address comes from a proxy header
+		addr := app.contextGetClientAddr(r)
+
+		attrs := []any{
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", mw.statusCode,
+			"duration", duration,
+			"client_ip", addr.IP,
+			"client_port", addr.Port,
+			"request_id", app.contextGetRequestID(r),
+		}
+		// the sample rate lets the log readers estimate the number of requests
+		if successful && !slow && rate > 1 {
+			attrs = append(attrs, "sample_rate", rate)
+		}
+
+		switch {
+		case mw.statusCode >= 500:
+			app.logger.Error("request handled", attrs...)
+		case slow || mw.statusCode >= 400:
+			app.logger.Warn("request handled", attrs...)
+		default:
+			app.logger.Info("request handled", attrs...)
+		}
+	})
+}
+
+// logBodies logs the request and response bodies of every request, for debugging
+// integrations in development. The bodies are truncated and the values of the JSON
+// fields named like one of the redacted fields are replaced, at any depth
+func (app *application) logBodies(next http.Handler) http.Handler {
+	if !app.config.debugBodies.enabled {
+		return next
+	}
+
+	maxSize := app.config.debugBodies.maxSize
+	// the bodies are redacted before being truncated, so more than what is logged is
+	// kept. A body bigger than this is no longer valid JSON once cut, and redactBody
+	// falls back to redactedRX
+	captureSize := max(maxSize, maxBodySize)
+
+	redacted := make(map[string]bool)
+	quoted := make([]string, 0, len(app.config.debugBodies.redactFields))
+	for _, field := range app.config.debugBodies.redactFields {
+		redacted[strings.ToLower(field)] = true
+		quoted = append(quoted, regexp.QuoteMeta(field))
+	}
+	// matches a redacted field and its value, even if the value has been cut
+	redactedRX := regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+
+	redact := func(body []byte) string {
+		var value any
+		if json.Unmarshal(body, &value) == nil {
+			js, err := json.Marshal(redactValue(value, redacted))
+			if err == nil {
+				body = js
+			}
+		} else if len(quoted) > 0 {
+			body = redactedRX.ReplaceAll(body, []byte(`${1}"[REDACTED]"`))
+		}
+
+		if len(body) > maxSize {
+			return string(body[:maxSize]) + "...(truncated)"
+		}
+
+		return string(body)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the start of the body is read here, and it's put back in front of the
+		// rest, so the handler reads the same body as without this middleware
+		head, err := io.ReadAll(io.LimitReader(r.Body, int64(captureSize)+1))
+		if err != nil {
+			app.logError(r, err)
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+		// decompressBody() deletes the Content-Encoding header once the handler reads
+		// the body, so it must be checked before calling the handler
+		requestBody := "(compressed)"
+		if encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); encoding == "" || strings.EqualFold(encoding, "identity") {
+			requestBody = redact(head)
+		}
+
+		bw := &bodyLogResponseWriter{wrapped: w, statusCode: http.StatusOK, maxSize: captureSize}
+
+		next.ServeHTTP(bw, r)
+
+		app.logger.Info("http bodies",
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", bw.statusCode,
+			"request_body", requestBody,
+			"response_body", redact(bw.body.Bytes()),
+			"request_id", app.contextGetRequestID(r),
+		)
 	})
 }
+
+// redactValue replaces the values of the redacted fields of a decoded JSON value
+func redactValue(value any, redacted map[string]bool) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if redacted[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactValue(field, redacted)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item, redacted)
+		}
+	}
+
+	return value
+}
+
+// bodyLogResponseWriter keeps a copy of the first maxSize bytes of the response body
+type bodyLogResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+	maxSize       int
+	body          bytes.Buffer
+}
+
+func (bw *bodyLogResponseWriter) Header() http.Header {
+	return bw.wrapped.Header()
+}
+
+func (bw *bodyLogResponseWriter) WriteHeader(statusCode int) {
+	bw.wrapped.WriteHeader(statusCode)
+
+	if !bw.headerWritten {
+		bw.statusCode = statusCode
+		bw.headerWritten = true
+	}
+}
+
+func (bw *bodyLogResponseWriter) Write(b []byte) (int, error) {
+	bw.headerWritten = true
+
+	if remaining := bw.maxSize + 1 - bw.body.Len(); remaining > 0 {
+		bw.body.Write(b[:min(len(b), remaining)])
+	}
+
+	return bw.wrapped.Write(b)
+}
+
+func (bw *bodyLogResponseWriter) Unwrap() http.ResponseWriter {
+	return bw.wrapped
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+)
+
+func TestLogBodiesRequestBody(t *testing.T) {
+	const body = `{"email":"alice@example.com","password":"pa55word1234"}`
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(body))
+	gw.Close()
+
+	tests := []struct {
+		name            string
+		encoding        string
+		body            []byte
+		wantRequestBody string
+	}{
+		{"plain", "", []byte(body), `{"email":"alice@example.com","password":"[REDACTED]"}`},
+		{"identity", "identity", []byte(body), `{"email":"alice@example.com","password":"[REDACTED]"}`},
+		{"gzip", "gzip", compressed.Bytes(), "(compressed)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			app := newTestApplication(t, data.Models{})
+			app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+			app.config.debugBodies.enabled = true
+			app.config.debugBodies.maxSize = 2048
+			app.config.debugBodies.redactFields = []string{"password"}
+
+			// the handler decompresses the body, which deletes its Content-Encoding
+			handler := app.logBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var input struct {
+					Email    string `json:"email"`
+					Password string `json:"password"`
+				}
+
+				err := app.readJSON(w, r, &input)
+				if err != nil {
+					t.Errorf("unable to read the body: %v", err)
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			var entry struct {
+				RequestBody string `json:"request_body"`
+			}
+			err := json.Unmarshal(logs.Bytes(), &entry)
+			if err != nil {
+				t.Fatalf("unable to decode the log %q: %v", logs.Bytes(), err)
+			}
+
+			if entry.RequestBody != tt.wantRequestBody {
+				t.Errorf("got request body %q, want %q", entry.RequestBody, tt.wantRequestBody)
+			}
+		})
+	}
+}
+
+func TestRequireBasicAuthOrPermissions(t *testing.T) {
+	tests := []struct {
+		name          string
+		username      string
+		basicAuth     []string
+		token         string
+		permissions   []string
+		wantStatus    int
+		wantChallenge bool
+	}{
+		{"anonymous", "admin", nil, "", nil, http.StatusUnauthorized, true},
+		{"valid basic auth", "admin", []string{"admin", "secret"}, "", nil, http.StatusOK, false},
+		{"invalid basic auth", "admin", []string{"admin", "wrong"}, "", nil, http.StatusUnauthorized, true},
+		{"token with the permission", "admin", nil, testToken, []string{"metrics:read"}, http.StatusOK, false},
+		{"token without the permission", "admin", nil, testToken, []string{"movies:read"}, http.StatusUnauthorized, true},
+		{"anonymous without basic auth", "", nil, "", nil, http.StatusUnauthorized, false},
+		{"basic auth when it isn't configured", "", []string{"admin", "secret"}, "", nil, http.StatusUnauthorized, false},
+		{"token without basic auth", "", nil, testToken, []string{"metrics:read"}, http.StatusOK, false},
+		{"token without the permission nor basic auth", "", nil, testToken, nil, http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, data.Models{Users: testUsers(tt.permissions...)})
+			app.config.basicAuth.username = tt.username
+			app.config.basicAuth.password = "secret"
+
+			ts := newTestServer(t, app)
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/debug/vars", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.basicAuth != nil {
+				req.SetBasicAuth(tt.basicAuth[0], tt.basicAuth[1])
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			challenge := strings.HasPrefix(res.Header.Get("WWW-Authenticate"), "Basic realm=")
+			if challenge != tt.wantChallenge {
+				t.Errorf("got WWW-Authenticate %q, want a basic challenge %t", res.Header.Get("WWW-Authenticate"), tt.wantChallenge)
+			}
+		})
+	}
+}
+
+func TestRealIPBeforeLogsAndRateLimit(t *testing.T) {
+	var logs bytes.Buffer
+
+	app := newTestApplication(t, data.Models{Users: testUsers()})
+	app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	app.config.requestLog.enabled = true
+	app.config.requestLog.sampleRate = 1
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 1
+
+	handler := app.routes()
+
+	// every request comes from the same proxy, on behalf of two clients
+	send := func(clientIP string) int {
+		r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+		r.RemoteAddr = "10.0.0.1:40000"
+		r.Header.Set("X-Real-IP", clientIP)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	if status := send("203.0.113.7"); status == http.StatusTooManyRequests {
+		t.Fatalf("got status %d for the first request of the first client", status)
+	}
+	if status := send("198.51.100.4"); status == http.StatusTooManyRequests {
+		t.Errorf("got status %d for the first request of the second client, the clients share a limit", status)
+	}
+	if status := send("203.0.113.7"); status != http.StatusTooManyRequests {
+		t.Errorf("got status %d for the second request of the first client, want %d", status, http.StatusTooManyRequests)
+	}
+
+	var entry struct {
+		Msg        string `json:"msg"`
+		ClientIP   string `json:"client_ip"`
+		ClientPort string `json:"client_port"`
+	}
+
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		err := dec.Decode(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Msg == "request handled" {
+			break
+		}
+	}
+
+	if entry.Msg != "request handled" || entry.ClientIP != "203.0.113.7" || entry.ClientPort != "" {
+		t.Errorf("got request log %+v, want the client IP 203.0.113.7 without port", entry)
+	}
+}
+
+func TestLimitQueryBeforeTimezone(t *testing.T) {
+	app := newTestApplication(t, data.Models{Users: testUsers()})
+	app.config.server.maxQueryLength = 64
+
+	handler := app.routes()
+
+	// the query string is rejected before the timezone is read from it
+	r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck?tz=Invalid/Zone&pad="+strings.Repeat("a", 64), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestURITooLong)
+	}
+}
+
+func TestRateLimitStateBehindProxy(t *testing.T) {
+	app := newTestApplication(t, data.Models{Users: testUsers()})
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 3
+
+	handler := app.routes()
+
+	// every request comes from the same proxy, on behalf of two clients
+	send := func(path string, clientIP string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "10.0.0.1:40000"
+		r.Header.Set("X-Real-IP", clientIP)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	remaining := func(clientIP string) int {
+		t.Helper()
+
+		w := send("/v1/ratelimit", clientIP)
+
+		var body struct {
+			RateLimit struct {
+				Remaining int `json:"remaining"`
+			} `json:"rate_limit"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatalf("unable to decode the response body %q: %v", w.Body, err)
+		}
+
+		return body.RateLimit.Remaining
+	}
+
+	send("/v1/healthcheck", "203.0.113.7")
+
+	// GET /ratelimit reports the bucket the requests of the client are limited with,
+	// and counts against it
+	if got := remaining("203.0.113.7"); got != 1 {
+		t.Errorf("got %d remaining requests for the first client, want 1", got)
+	}
+	if got := remaining("198.51.100.4"); got != 2 {
+		t.Errorf("got %d remaining requests for the second client, want 2", got)
+	}
+
+	if w := send("/v1/healthcheck", "203.0.113.7"); w.Code == http.StatusTooManyRequests {
+		t.Fatalf("got status %d for the third request of the first client", w.Code)
+	}
+	if w := send("/v1/healthcheck", "203.0.113.7"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d once the first client ran out of requests, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -1,24 +1,46 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/schema"
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
+// movieSortSafeList has the values allowed in the sort query param of the movies list
+var movieSortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		// CreatedAt keeps the original creation date when importing a catalog, it's
+		// only honored for users with the imports:write permission
+		CreatedAt *time.Time   `json:"created_at"`
+		Title     string       `json:"title"`
+		Year      int32        `json:"year"`
+		Runtime   data.Runtime `json:"runtime"`
+		Genres    []string     `json:"genres"`
+		// Status is published when missing, send draft to stage the movie
+		Status string `json:"status"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	// initialize a new validator instance
+	v := app.newValidator(r)
+
+	// the movie_create schema violations are added to the validator, so they are
+	// reported along with the rest of the validation errors below
+	err := app.readJSONWithSchema(w, r, "movie_create", &input, v)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -26,30 +48,68 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// copy the values from the input struct to a new movie struct
 	movie := &data.Movie{
-		Title:   input.Title,
+		Title:   strings.TrimSpace(input.Title),
 		Year:    input.Year,
 		Runtime: input.Runtime,
 		Genres:  input.Genres,
+		Status:  cmp.Or(input.Status, data.MovieStatusPublished),
 	}
 
-	// initialize a new validator instance
-	v := validator.New()
+	// only importers can backdate movies
+	if input.CreatedAt != nil {
+		permissions, err := app.contextGetPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include("imports:write") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		movie.CreatedAt = *input.CreatedAt
+		v.Check(!movie.CreatedAt.After(time.Now()), "created_at", "must not be in the future")
+	}
+
+	// when the validate_only query param is true, we only validate the payload
+	// and return it without inserting it, so clients can pre-check their data
+	validateOnly := app.readBool(r.URL.Query(), "validate_only", false, v)
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if validateOnly {
+		err = app.writeJson(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	err = app.modelsFor(r).Movies.Insert(movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			v.AddError("title", "a movie with this title and year already exists")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%s", movie.ID))
+	headers.Set("Location", app.absoluteURL(r, app.apiPath(fmt.Sprintf("/movies/%s", movie.ID))))
+
+	if preferMinimal(r) {
+		app.writeMinimal(w, headers)
+		return
+	}
 
-	err = app.writeJson(w, http.StatusCreated, envelope{
+	err = app.writeJson(w, r, http.StatusCreated, envelope{
 		"movie": movie,
 	}, headers)
 	if err != nil {
@@ -57,14 +117,123 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// maxValidateBatch is the maximum number of movies validated by a single request
+const maxValidateBatch = 1000
+
+// validateMoviesBatchHandler validates the movies of a {"movies": [...]} body like
+// createMovieHandler does, without inserting them, and reports the result of each
+// movie in the order of the input, so an import can be previewed before running it
+func (app *application) validateMoviesBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Movies []json.RawMessage `json:"movies"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	v.Check(len(input.Movies) >= 1, "movies", "must contain at least 1 movie")
+	v.Check(len(input.Movies) <= maxValidateBatch, "movies", v.Sprintf("must not contain more than %d movies", maxValidateBatch))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	type result struct {
+		Index  int                   `json:"index"`
+		Valid  bool                  `json:"valid"`
+		Errors validator.FieldErrors `json:"errors,omitzero"`
+	}
+
+	results := make([]result, len(input.Movies))
+	invalid := 0
+
+	for i, raw := range input.Movies {
+		v := app.newValidator(r)
+		app.validateMovieJSON(v, raw)
+
+		results[i] = result{Index: i, Valid: v.Valid()}
+		if !v.Valid() {
+			results[i].Errors = v.FieldErrors()
+			invalid++
+		}
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{
+		"results": results,
+		"valid":   len(results) - invalid,
+		"invalid": invalid,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateMovieJSON adds to v the errors createMovieHandler would report for the JSON
+// of a movie: the movie_create schema violations, the values which can't be decoded
+// and the ValidateMovie errors
+func (app *application) validateMovieJSON(v *validator.Validator, raw json.RawMessage) {
+	violations, err := schema.Validate("movie_create", raw)
+	if err != nil {
+		v.AddError("movie", "must be a JSON object")
+		return
+	}
+
+	// sorted, so the violations are always reported in the same order
+	for _, field := range slices.Sorted(maps.Keys(violations)) {
+		v.AddError(field, violations[field])
+	}
+
+	var input struct {
+		CreatedAt *time.Time   `json:"created_at"`
+		Title     string       `json:"title"`
+		Year      int32        `json:"year"`
+		Runtime   data.Runtime `json:"runtime"`
+		Genres    []string     `json:"genres"`
+		Status    string       `json:"status"`
+	}
+
+	err = json.Unmarshal(raw, &input)
+	if err != nil {
+		switch {
+		// the schema already reported the fields with the wrong type
+		case !v.Valid():
+		case errors.Is(err, data.ErrInvalidRuntimeFormat):
+			v.AddError("runtime", "invalid runtime format")
+		default:
+			v.AddError("movie", "must be a JSON object")
+		}
+		return
+	}
+
+	movie := &data.Movie{
+		Title:   strings.TrimSpace(input.Title),
+		Year:    input.Year,
+		Runtime: input.Runtime,
+		Genres:  input.Genres,
+		Status:  cmp.Or(input.Status, data.MovieStatusPublished),
+	}
+
+	if input.CreatedAt != nil {
+		v.Check(!input.CreatedAt.After(time.Now()), "created_at", "must not be in the future")
+	}
+
+	data.ValidateMovie(v, movie)
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
-	if err != nil || id == "" {
+	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -75,7 +244,17 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJson(w, http.StatusOK, envelope{"movie": movie}, nil)
+	visible, err := app.movieVisible(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !visible {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -88,12 +267,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
-	if movie == nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -104,6 +278,20 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	qs := r.URL.Query()
+
+	err = app.checkQueryParams(r, qs, "return")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// with return=changed the response only has the fields changed by the update,
+	// found by comparing the movie with the one we've just read
+	returnChanged := app.readString(qs, "return", "representation") == "changed"
+	before := *movie
+	before.Genres = slices.Clone(movie.Genres)
+
 	// if the request contains a X-Expected-Version header, verify that the movie
 	// version in the database matches the expected version specified in the header
 	if r.Header.Get("X-Expected-Version") != "" {
@@ -118,6 +306,17 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		Year    *int32        `json:"year"`
 		Runtime *data.Runtime `json:"runtime"`
 		Genres  []string      `json:"genres"`
+		// AddGenres and RemoveGenres change the genres without sending the whole
+		// array. They are applied after Genres, removals first
+		AddGenres    []string `json:"add_genres"`
+		RemoveGenres []string `json:"remove_genres"`
+		Status       *string  `json:"status"`
+		// Version works like the X-Expected-Version header, the update fails with a
+		// conflict when the movie has been changed since the client read it
+		Version *int32 `json:"version"`
+		// CreatedAt is accepted so clients can send back a movie as they got it, but
+		// it's never applied, the creation date of a movie can't be changed
+		CreatedAt json.RawMessage `json:"created_at"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -126,48 +325,157 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if input.Title == nil && input.Year == nil && input.Runtime == nil && input.Genres == nil {
+	v := app.newValidator(r)
+
+	if input.Version != nil {
+		if v.Check(*input.Version >= 0, "version", "must not be negative"); !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		if *input.Version != movie.Version {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	if input.Title == nil && input.Year == nil && input.Runtime == nil && input.Genres == nil &&
+		input.AddGenres == nil && input.RemoveGenres == nil && input.Status == nil {
 		app.badRequestResponse(w, r, errors.New("missing values to update"))
 		return
 	}
 
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
-	if input.Year != nil {
-		movie.Year = *input.Year
+	// with X-Retry-On-Conflict the changes are applied again on the latest version of
+	// the movie when it's changed by someone else in the meantime. It's ignored when
+	// the request expects a specific version, as it must fail in that case
+	retryOnConflict := false
+	if header := r.Header.Get("X-Retry-On-Conflict"); header != "" {
+		retryOnConflict, err = strconv.ParseBool(header)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("the X-Retry-On-Conflict header must be true or false"))
+			return
+		}
 	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+	if input.Version != nil || r.Header.Get("X-Expected-Version") != "" {
+		retryOnConflict = false
 	}
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+
+	applyInput := func(movie *data.Movie) {
+		if input.Title != nil {
+			movie.Title = strings.TrimSpace(*input.Title)
+		}
+		if input.Year != nil {
+			movie.Year = *input.Year
+		}
+		if input.Runtime != nil {
+			movie.Runtime = *input.Runtime
+		}
+		// the genres are copied, since remove_genres changes them in place and the
+		// input is applied again on each retry
+		if input.Genres != nil {
+			movie.Genres = slices.Clone(input.Genres)
+		}
+		if input.RemoveGenres != nil {
+			movie.Genres = slices.DeleteFunc(movie.Genres, func(genre string) bool {
+				return slices.Contains(input.RemoveGenres, genre)
+			})
+		}
+		// adding a genre the movie already has is a no-op, the max-5 rule is checked
+		// on the resulting genres by ValidateMovie()
+		for _, genre := range input.AddGenres {
+			if !slices.Contains(movie.Genres, genre) {
+				movie.Genres = append(movie.Genres, genre)
+			}
+		}
+		if input.Status != nil {
+			movie.Status = *input.Status
+		}
 	}
 
-	v := validator.New()
+	for retries := 0; ; retries++ {
+		applyInput(movie)
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		err = app.modelsFor(r).Movies.Update(movie)
+		if !errors.Is(err, data.ErrEditConflict) || !retryOnConflict || retries >= app.config.editConflictRetries {
+			break
+		}
 
-	err = app.models.Movies.Update(movie)
+		movie, err = app.modelsFor(r).Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		before = *movie
+		before.Genres = slices.Clone(movie.Genres)
+	}
 	if err != nil {
-		if errors.Is(err, data.ErrEditConflict) {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
-			return
+		case errors.Is(err, data.ErrDuplicateMovie):
+			v.AddError("title", "a movie with this title and year already exists")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		app.serverErrorResponse(w, r, err)
+	// Prefer: return=minimal wins over return=changed, as it asks for even less
+	if preferMinimal(r) {
+		headers := make(http.Header)
+		headers.Set("Location", app.absoluteURL(r, app.apiPath(fmt.Sprintf("/movies/%s", movie.ID))))
+		app.writeMinimal(w, headers)
 		return
 	}
 
-	err = app.writeJson(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if returnChanged {
+		err = app.writeJson(w, r, http.StatusOK, envelope{"movie": changedMovieFields(&before, movie)}, nil)
+	} else {
+		err = app.writeJson(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// changedMovieFields returns the fields of after which are different in before, keyed
+// like in the JSON of a movie, along with the id and the version
+func changedMovieFields(before *data.Movie, after *data.Movie) envelope {
+	changed := envelope{
+		"id":      after.ID,
+		"version": after.Version,
+	}
+
+	if after.Title != before.Title {
+		changed["title"] = after.Title
+	}
+	if after.Year != before.Year {
+		changed["year"] = after.Year
+	}
+	if after.Runtime != before.Runtime {
+		changed["runtime"] = after.Runtime
+	}
+	if !slices.Equal(after.Genres, before.Genres) {
+		changed["genres"] = after.Genres
+	}
+	if after.Status != before.Status {
+		changed["status"] = after.Status
+	}
+
+	return changed
+}
+
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -175,7 +483,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	err = app.modelsFor(r).Movies.Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -186,7 +494,9 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJson(w, http.StatusOK, envelope{"message": "movie successfully delete"}, nil)
+	app.recordAudit(r, app.requestActorID(r), data.AuditMovieDelete, id, nil)
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"message": "movie successfully delete"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -194,32 +504,51 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		Title    string
+		Genres   []string
+		Statuses []string
 		data.Filters
 	}
 
-	v := validator.New()
+	v := app.newValidator(r)
 
 	qs := r.URL.Query()
 
+	err := app.checkQueryParams(r, qs, "title", "genres", "status", "page", "page_size", "sort")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	input.Statuses = app.readCSV(qs, "status", []string{})
+	for _, status := range input.Statuses {
+		data.ValidateMovieStatus(v, status)
+	}
+
 	input.Page = app.readInt(qs, "page", 1, v)
 	input.PageSize = app.readInt(qs, "page_size", 20, v)
 
-	input.Sort = app.readString(qs, "sort", "id")
-	input.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Sort = app.readString(qs, "sort", app.config.movieSort)
+	input.SortSafeList = movieSortSafeList
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	statuses, err := app.visibleMovieStatuses(r, input.Statuses)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(
+	movies, metadata, err := app.modelsFor(r).Movies.GetAll(
 		input.Title,
 		input.Genres,
+		statuses,
 		input.Filters,
 	)
 	if err != nil {
@@ -227,8 +556,336 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJson(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJson(w, r, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) countMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "title", "genres", "status")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+
+	v := app.newValidator(r)
+
+	requested := app.readCSV(qs, "status", []string{})
+	for _, status := range requested {
+		data.ValidateMovieStatus(v, status)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	statuses, err := app.visibleMovieStatuses(r, requested)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	count, err := app.modelsFor(r).Movies.Count(title, genres, statuses)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"count": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// randomMovieHandler returns a random movie, optionally with all the genres given
+// in the genres query param
+func (app *application) randomMovieHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "genres")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	genres := app.readCSV(qs, "genres", []string{})
+
+	// the random movie is always a published one, even for the users who can see
+	// the rest of the movies
+	movie, err := app.modelsFor(r).Movies.GetRandom(genres, []string{data.MovieStatusPublished})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// suggestMoviesHandler returns the published movies whose title starts with the q
+// query param, for search-as-you-type boxes
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "q", "limit")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	prefix := strings.TrimSpace(app.readString(qs, "q", ""))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(prefix != "", "q", "must be provided")
+	v.Check(utf8.RuneCountInString(prefix) <= 100, "q", "must not be more than 100 characters long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	movies, err := app.modelsFor(r).Movies.Suggest(prefix, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) upsertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	externalID := httprouter.ParamsFromContext(r.Context()).ByName("external_id")
+
+	var input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+		// Status is published when missing, like the rest of the fields it replaces
+		// the status of an existing movie
+		Status string `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie := &data.Movie{
+		ExternalID: externalID,
+		Title:      strings.TrimSpace(input.Title),
+		Year:       input.Year,
+		Runtime:    input.Runtime,
+		Genres:     input.Genres,
+		Status:     cmp.Or(input.Status, data.MovieStatusPublished),
+	}
+
+	v := app.newValidator(r)
+
+	data.ValidateExternalID(v, movie.ExternalID)
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	created, err := app.modelsFor(r).Movies.Upsert(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			v.AddError("title", "a movie with this title and year already exists")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the minimal response is the same whether the movie was created or updated
+	if preferMinimal(r) {
+		headers := make(http.Header)
+		headers.Set("Location", app.absoluteURL(r, app.apiPath(fmt.Sprintf("/movies/%s", movie.ID))))
+		app.writeMinimal(w, headers)
+		return
+	}
+
+	status := http.StatusOK
+	headers := make(http.Header)
+
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", app.absoluteURL(r, app.apiPath(fmt.Sprintf("/movies/%s", movie.ID))))
+	}
+
+	err = app.writeJson(w, r, status, envelope{"movie": movie, "created": created}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listGenresHandler returns the genres movies can have, an empty list means that any
+// genre is allowed
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJson(w, r, http.StatusOK, envelope{"genres": data.AllowedGenres()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieHistoryHandler returns the previous versions of a movie, oldest first unless
+// sorted otherwise
+func (app *application) movieHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	qs := r.URL.Query()
+
+	err = app.checkQueryParams(r, qs, "page", "page_size", "sort")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var filters data.Filters
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	filters.Sort = app.readString(qs, "sort", "version")
+	filters.SortSafeList = []string{"version", "-version"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	movie, err := app.modelsFor(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	visible, err := app.movieVisible(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !visible {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	versions, metadata, err := app.modelsFor(r).Movies.GetHistory(movie.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"versions": versions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setMovieStatusHandler returns a handler which sets the status of a movie, e.g. to
+// publish a draft
+func (app *application) setMovieStatusHandler(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		movie, err := app.modelsFor(r).Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// setting the status the movie already has doesn't bump its version
+		if movie.Status != status {
+			movie.Status = status
+
+			err = app.modelsFor(r).Movies.Update(movie)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrEditConflict):
+					app.editConflictResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+
+		err = app.writeJson(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// visibleMovieStatuses returns the statuses of the movies the request user can see,
+// where an empty list means any status. The users who can change movies see the
+// requested statuses, the rest of the users only see the published movies
+func (app *application) visibleMovieStatuses(r *http.Request, requested []string) ([]string, error) {
+	permissions, err := app.contextGetPermissions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if permissions.Include("movies:write") {
+		return requested, nil
+	}
+
+	return []string{data.MovieStatusPublished}, nil
+}
+
+// movieVisible reports whether the request user can see the movie, the ones who can't
+// get a 404 as if the movie didn't exist
+func (app *application) movieVisible(r *http.Request, movie *data.Movie) (bool, error) {
+	statuses, err := app.visibleMovieStatuses(r, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return len(statuses) == 0 || slices.Contains(statuses, movie.Status), nil
+}
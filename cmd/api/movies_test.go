@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/data/mocks"
+)
+
+// testMovieID is the ID of the movie returned by testMovies()
+const testMovieID = "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81"
+
+// testMovieCreatedAt is the creation date of the movie returned by testMovies()
+var testMovieCreatedAt = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// testMovies returns a fake movie repository with a single published movie
+func testMovies() *mocks.MovieModel {
+	return &mocks.MovieModel{
+		GetFunc: func(id string) (*data.Movie, error) {
+			if id != testMovieID {
+				return nil, data.ErrRecordNotFound
+			}
+			return &data.Movie{
+				ID:        testMovieID,
+				CreatedAt: testMovieCreatedAt,
+				Title:     "Moana",
+				Year:      2016,
+				Runtime:   107,
+				Genres:    []string{"animation", "adventure"},
+				Status:    data.MovieStatusPublished,
+				Version:   1,
+			}, nil
+		},
+	}
+}
+
+func TestShowMovie(t *testing.T) {
+	models := data.Models{
+		Movies: testMovies(),
+		Users:  testUsers("movies:read"),
+	}
+
+	ts := newTestServer(t, newTestApplication(t, models))
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantTitle  string
+	}{
+		{"existing movie", "/v1/movies/" + testMovieID, http.StatusOK, "Moana"},
+		{"missing movie", "/v1/movies/0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f99", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.get(t, tt.path, testToken)
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantTitle == "" {
+				return
+			}
+
+			var body struct {
+				Movie data.Movie `json:"movie"`
+			}
+			res.decode(t, &body)
+
+			if body.Movie.Title != tt.wantTitle {
+				t.Errorf("got title %q, want %q", body.Movie.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestUpdateMovieDatabaseErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"not found", data.ErrRecordNotFound, http.StatusNotFound},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"circuit open", data.ErrCircuitOpen, http.StatusServiceUnavailable},
+		{"pool busy", data.ErrPoolBusy, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			models := data.Models{
+				Movies: &mocks.MovieModel{
+					GetFunc: func(id string) (*data.Movie, error) {
+						return nil, tt.err
+					},
+				},
+				Users: testUsers("movies:read", "movies:write"),
+			}
+
+			ts := newTestServer(t, newTestApplication(t, models))
+
+			res := ts.do(t, http.MethodPatch, "/v1/movies/"+testMovieID, testToken, `{"title": "Moana 2"}`)
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestCreateMovieGenres(t *testing.T) {
+	models := data.Models{Users: testUsers("movies:write")}
+
+	ts := newTestServer(t, newTestApplication(t, models))
+
+	tests := []struct {
+		name       string
+		genres     string
+		wantStatus int
+		wantError  string
+	}{
+		{"null", `,"genres":null`, http.StatusUnprocessableEntity, "must be provided"},
+		{"empty array", `,"genres":[]`, http.StatusUnprocessableEntity, "must contain at least 1 genre"},
+		{"omitted", ``, http.StatusUnprocessableEntity, "must be provided"},
+		{"one genre", `,"genres":["drama"]`, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// validate_only keeps the handler from inserting the movie
+			body := `{"title":"Moana","year":2016,"runtime":"107 mins"` + tt.genres + `}`
+
+			res := ts.do(t, http.MethodPost, "/v1/movies?validate_only=true", testToken, body)
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantError == "" {
+				return
+			}
+
+			if got := res.fieldErrors(t)["genres"]; got != tt.wantError {
+				t.Errorf("got genres error %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestMovieCreatedAtCantBeChanged(t *testing.T) {
+	const createdAt = `"2000-01-01T00:00:00Z"`
+
+	t.Run("PATCH", func(t *testing.T) {
+		var updated *data.Movie
+
+		movies := testMovies()
+		movies.UpdateFunc = func(movie *data.Movie) error {
+			updated = movie
+			return nil
+		}
+
+		ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:write")}))
+
+		res := ts.do(t, http.MethodPatch, "/v1/movies/"+testMovieID, testToken, `{"title":"Moana 2","created_at":`+createdAt+`}`)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+		}
+
+		if !updated.CreatedAt.Equal(testMovieCreatedAt) {
+			t.Errorf("got created_at %v stored, want %v", updated.CreatedAt, testMovieCreatedAt)
+		}
+
+		var body struct {
+			Movie data.Movie `json:"movie"`
+		}
+		res.decode(t, &body)
+
+		if !body.Movie.CreatedAt.Equal(testMovieCreatedAt) {
+			t.Errorf("got created_at %v in the response, want %v", body.Movie.CreatedAt, testMovieCreatedAt)
+		}
+	})
+
+	t.Run("PATCH with only created_at", func(t *testing.T) {
+		movies := testMovies()
+		movies.UpdateFunc = func(movie *data.Movie) error {
+			t.Error("the movie was updated")
+			return nil
+		}
+
+		ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:write")}))
+
+		res := ts.do(t, http.MethodPatch, "/v1/movies/"+testMovieID, testToken, `{"created_at":`+createdAt+`}`)
+		if res.status != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusBadRequest, res.body)
+		}
+	})
+
+	t.Run("PUT", func(t *testing.T) {
+		movies := &mocks.MovieModel{
+			UpsertFunc: func(movie *data.Movie) (bool, error) {
+				t.Error("the movie was upserted")
+				return false, nil
+			},
+		}
+
+		ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:write")}))
+
+		body := `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"],"created_at":` + createdAt + `}`
+
+		res := ts.do(t, http.MethodPut, "/v1/movies/external/imdb-tt3521164", testToken, body)
+		if res.status != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d: %s", res.status, http.StatusBadRequest, res.body)
+		}
+	})
+}
+
+func TestCreateMovieTitle(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, data.Models{Users: testUsers("movies:write")}))
+
+	tests := []struct {
+		name       string
+		title      string
+		wantStatus int
+		wantTitle  string
+	}{
+		{"cjk", `"千と千尋の神隠し"`, http.StatusOK, "千と千尋の神隠し"},
+		{"emoji", `"🎬 Moana 🌊"`, http.StatusOK, "🎬 Moana 🌊"},
+		{"surrounding whitespace", `"  Moana \t"`, http.StatusOK, "Moana"},
+		{"only whitespace", `"   "`, http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"title":` + tt.title + `,"year":2016,"runtime":"107 mins","genres":["animation"]}`
+
+			res := ts.do(t, http.MethodPost, "/v1/movies?validate_only=true", testToken, body)
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantTitle == "" {
+				return
+			}
+
+			var resBody struct {
+				Movie data.Movie `json:"movie"`
+			}
+			res.decode(t, &resBody)
+
+			if resBody.Movie.Title != tt.wantTitle {
+				t.Errorf("got title %q, want %q", resBody.Movie.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestMovieRoutesMalformedID(t *testing.T) {
+	// the malformed ids never reach the database
+	movies := &mocks.MovieModel{
+		GetFunc: func(id string) (*data.Movie, error) {
+			t.Errorf("the movie %q was read", id)
+			return nil, data.ErrRecordNotFound
+		},
+		DeleteFunc: func(id string) error {
+			t.Errorf("the movie %q was deleted", id)
+			return data.ErrRecordNotFound
+		},
+	}
+
+	ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:read", "movies:write")}))
+
+	ids := []string{"abc", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8g", "1%27%20OR%201=1"}
+
+	for _, id := range ids {
+		routes := []struct {
+			method string
+			path   string
+		}{
+			{http.MethodGet, "/v1/movies/" + id},
+			{http.MethodPatch, "/v1/movies/" + id},
+			{http.MethodDelete, "/v1/movies/" + id},
+			{http.MethodGet, "/v1/movies/" + id + "/history"},
+		}
+
+		for _, route := range routes {
+			t.Run(route.method+" "+route.path, func(t *testing.T) {
+				res := ts.do(t, route.method, route.path, testToken, `{"title":"Moana"}`)
+				if res.status != http.StatusNotFound {
+					t.Errorf("got status %d, want %d: %s", res.status, http.StatusNotFound, res.body)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateMovieGenresRetry(t *testing.T) {
+	var updates [][]string
+
+	movies := testMovies()
+	movies.UpdateFunc = func(movie *data.Movie) error {
+		updates = append(updates, slices.Clone(movie.Genres))
+
+		// the first update conflicts with someone else's, so the changes are applied
+		// again on the movie read after it
+		if len(updates) == 1 {
+			return data.ErrEditConflict
+		}
+		return nil
+	}
+
+	ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:write")}))
+
+	req, err := http.NewRequest(http.MethodPatch, ts.URL+"/v1/movies/"+testMovieID, strings.NewReader(`{"genres":["drama","comedy","romance"],"remove_genres":["drama"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("X-Retry-On-Conflict", "true")
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	want := []string{"comedy", "romance"}
+	for i, genres := range updates {
+		if !slices.Equal(genres, want) {
+			t.Errorf("got genres %q in update %d, want %q", genres, i+1, want)
+		}
+	}
+	if len(updates) != 2 {
+		t.Errorf("got %d updates, want 2", len(updates))
+	}
+}
+
+func TestListMoviesEmpty(t *testing.T) {
+	movies := &mocks.MovieModel{
+		GetAllFunc: func(title string, genres []string, statuses []string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+			return []*data.Movie{}, data.Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize}, nil
+		},
+	}
+
+	ts := newTestServer(t, newTestApplication(t, data.Models{Movies: movies, Users: testUsers("movies:read")}))
+
+	res := ts.get(t, "/v1/movies?title=nothing&page_size=10", testToken)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+	}
+
+	var body map[string]any
+	res.decode(t, &body)
+
+	if movies, ok := body["movies"].([]any); !ok || len(movies) != 0 {
+		t.Errorf("got movies %v, want an empty list", body["movies"])
+	}
+
+	want := map[string]any{
+		"current_page":  float64(1),
+		"page_size":     float64(10),
+		"total_pages":   float64(0),
+		"total_records": float64(0),
+		"has_next":      false,
+		"has_prev":      false,
+	}
+
+	metadata, _ := body["metadata"].(map[string]any)
+	if !maps.Equal(metadata, want) {
+		t.Errorf("got metadata %v, want %v", metadata, want)
+	}
+}
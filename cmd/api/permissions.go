@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+)
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.modelsFor(r).Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grantPermissionsHandler grants the given permission codes to all the given users
+func (app *application) grantPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.bulkPermissionsHandler(w, r, "granted", data.AuditPermissionsGrant, data.PermissionRepository.AddForUsers)
+}
+
+// revokePermissionsHandler revokes the given permission codes from all the given users
+func (app *application) revokePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.bulkPermissionsHandler(w, r, "revoked", data.AuditPermissionsRevoke, data.PermissionRepository.RemoveForUsers)
+}
+
+// bulkPermissionsHandler validates a {"user_ids": [...], "codes": [...]} body, checking
+// that every user and permission exists, and applies the change with apply. The change
+// is recorded in the audit log once per user with the given action, in the same
+// transaction, so the log never misses a change nor has one which didn't happen
+func (app *application) bulkPermissionsHandler(w http.ResponseWriter, r *http.Request, countKey string, auditAction string, apply func(permissions data.PermissionRepository, userIDs []string, codes []string) (int64, error)) {
+	var input struct {
+		UserIDs []string `json:"user_ids"`
+		Codes   []string `json:"codes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.Codes = data.NormalizePermissionCodes(input.Codes)
+
+	v := app.newValidator(r)
+
+	v.Check(len(input.UserIDs) >= 1, "user_ids", "must contain at least 1 user")
+	v.Check(len(input.UserIDs) <= 1000, "user_ids", "must not contain more than 1000 users")
+	v.Check(!slices.ContainsFunc(input.UserIDs, func(id string) bool {
+		return !validator.IsUUID(id)
+	}), "user_ids", "must only contain valid user IDs")
+	v.Check(len(input.Codes) >= 1, "codes", "must contain at least 1 permission code")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	missing, err := app.modelsFor(r).Users.GetMissingIDs(input.UserIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(missing) > 0 {
+		v.AddError("user_ids", v.Sprintf("these users don't exist: %s", strings.Join(missing, ", ")))
+	}
+
+	permissions, err := app.modelsFor(r).Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	unknown := slices.DeleteFunc(slices.Clone(input.Codes), permissions.Include)
+	if len(unknown) > 0 {
+		v.AddError("codes", v.Sprintf("these permissions don't exist: %s", strings.Join(unknown, ", ")))
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	var count int64
+	actorID := app.requestActorID(r)
+
+	err = app.withTx(r.Context(), func(tx pgx.Tx) error {
+		models := app.modelsForTx(tx)
+
+		var err error
+		count, err = apply(models.Permissions, input.UserIDs, input.Codes)
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range input.UserIDs {
+			err = models.Audit.Record(actorID, auditAction, userID, map[string]any{"codes": input.Codes})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{countKey: count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// showRateLimitHandler returns the rate limit of the client, so clients can check their
+// quota before running out of it. It runs behind rateLimit() and takes the key with
+// the same rateLimitFor(), so a client behind a proxy sees the bucket of its own
+// address. The request itself counts against the limit, so remaining is what is left
+// after it
+func (app *application) showRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if app.limiters == nil {
+		err := app.writeJson(w, r, http.StatusOK, envelope{"rate_limit": envelope{"enabled": false}}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	key, rps, burst := app.rateLimitFor(r)
+	remaining, refill := app.limiters.state(key, rps, burst)
+
+	err := app.writeJson(w, r, http.StatusOK, envelope{"rate_limit": envelope{
+		"enabled":   true,
+		"rps":       float64(rps),
+		"burst":     burst,
+		"remaining": int(math.Floor(remaining)),
+		// the time when the client can make burst requests again
+		"reset_at": time.Now().Add(refill).UTC().Truncate(time.Second),
+	}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
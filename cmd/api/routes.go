@@ -3,8 +3,11 @@ package main
 import (
 	"expvar"
 	"net/http"
+	"time"
 
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
 )
 
 func (app *application) routes() http.Handler {
@@ -17,25 +20,111 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	// every API route is relative to the configured base path (/v1 by default), so
+	// the mount point of the API is a single setting
+	router.HandlerFunc(http.MethodGet, app.apiPath("/healthcheck"), app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, app.apiPath("/ratelimit"), app.showRateLimitHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermissions("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermissions("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions("movies:write", app.deleteMovieHandler))
+	// every movie route must be wrapped by one of these two, reads need movies:read
+	// and anything that changes a movie needs movies:write
+	readMovies := func(next http.HandlerFunc) http.HandlerFunc {
+		return app.requirePermissions("movies:read", next)
+	}
+	writeMovies := func(next http.HandlerFunc) http.HandlerFunc {
+		return app.requirePermissions("movies:write", next)
+	}
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodGet, app.apiPath("/movies"), readMovies(app.listMoviesHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/movies"), writeMovies(app.createMovieHandler))
+	// httprouter doesn't allow static segments to conflict with a named parameter in
+	// the same position, so these GET /movies/<name> routes are dispatched by the
+	// GET /movies/:id route
+	staticMovieRoutes := map[string]http.HandlerFunc{
+		"count":   readMovies(app.countMoviesHandler),
+		"random":  readMovies(app.randomMovieHandler),
+		"suggest": readMovies(app.suggestMoviesHandler),
+	}
+	router.HandlerFunc(http.MethodGet, app.apiPath("/movies/:id"), app.staticParamRoutes("id", staticMovieRoutes, readMovies(app.showMovieHandler)))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/movies/:id/history"), readMovies(app.requireFeature("movie_history", app.movieHistoryHandler)))
+	router.HandlerFunc(http.MethodPatch, app.apiPath("/movies/:id"), writeMovies(app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, app.apiPath("/movies/:id"), writeMovies(app.deleteMovieHandler))
+	// same for POST /movies/validate-batch, which would conflict with the POST
+	// /movies/:id/<action> routes. There's no POST /movies/:id, so any other id is
+	// answered like the method wasn't allowed
+	staticMoviePostRoutes := map[string]http.HandlerFunc{
+		"validate-batch": writeMovies(app.validateMoviesBatchHandler),
+	}
+	router.HandlerFunc(http.MethodPost, app.apiPath("/movies/:id"), app.staticParamRoutes("id", staticMoviePostRoutes, app.methodNotAllowedResponse))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/movies/:id/publish"), writeMovies(app.setMovieStatusHandler(data.MovieStatusPublished)))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/movies/:id/unpublish"), writeMovies(app.setMovieStatusHandler(data.MovieStatusDraft)))
+	router.HandlerFunc(http.MethodPut, app.apiPath("/movies/external/:external_id"), writeMovies(app.upsertMovieHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/genres"), readMovies(app.listGenresHandler))
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodPost, app.apiPath("/users"), app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, app.apiPath("/users/activated"), app.activateUserHandler)
+	// at most 3 activation emails per client every few minutes, to prevent email bombing
+	router.HandlerFunc(http.MethodPost, app.apiPath("/users/activation"), app.rateLimitRoute(rate.Every(time.Minute), 3, app.resendActivationHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/users/email"), app.requireActivatedUser(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, app.apiPath("/users/email"), app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodPost, app.apiPath("/tokens/authentication"), app.createAuthenticationTokenHandler)
 
+	router.HandlerFunc(http.MethodPost, app.apiPath("/admin/users/import"), app.requirePermissions("users:write", app.importUsersHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/admin/permissions"), app.requirePermissions("permissions:read", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/admin/permissions/grant"), app.requirePermissions("permissions:write", app.grantPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/admin/permissions/revoke"), app.requirePermissions("permissions:write", app.revokePermissionsHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/admin/audit"), app.requirePermissions("audit:read", app.listAuditHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/admin/api-keys"), app.requirePermissions("api_keys:read", app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/admin/api-keys"), app.requirePermissions("api_keys:write", app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, app.apiPath("/admin/api-keys/:id"), app.requirePermissions("api_keys:write", app.revokeAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/admin/features"), app.requirePermissions("features:read", app.listFeaturesHandler))
+	router.HandlerFunc(http.MethodPut, app.apiPath("/admin/features/:name"), app.requirePermissions("features:write", app.setFeatureHandler))
+	router.HandlerFunc(http.MethodPut, app.apiPath("/admin/read-only"), app.requirePermissions("maintenance:write", app.setReadOnlyHandler))
+	router.HandlerFunc(http.MethodGet, app.apiPath("/admin/tokens"), app.requirePermissions("tokens:read", app.listTokensHandler))
+	router.HandlerFunc(http.MethodPost, app.apiPath("/admin/tokens/revoke"), app.requirePermissions("tokens:write", app.revokeTokensHandler))
+
+	// previews of the emails rendered with sample data, for tweaking their copy. They
+	// are never served in production
+	if app.config.env != "production" {
+		router.HandlerFunc(http.MethodGet, app.apiPath("/debug/email"), app.previewEmailHandler)
+	}
+
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requireBasicAuthOrPermissions("metrics:read", expvar.Handler().ServeHTTP))
+
+	// forwarded() checks the trusted proxies against the address of the connection,
+	// so it runs before realIP() replaces it with the one of the client. The request
+	// logs and the rate limits see the client address. timezone() parses the query
+	// string, so it runs after limitQuery() has checked its size
 	return app.metrics(
-		app.recoverPanic(
-			app.enableCORS(
-				app.rateLimit(app.authenticate(app.realIP(router))),
-			),
-		),
+		app.requestID(app.forwarded(app.realIP(app.logRequest(
+			app.localize(app.limitConcurrency(
+				app.recoverPanic(
+					app.secureHeaders(
+						app.enableCORS(
+							app.limitQuery(app.timezone(app.readOnlyMode(app.authenticate(app.rateLimit(app.logBodies(app.headRequests(router))))))),
+						),
+					),
+				),
+			)),
+		)))),
 	)
 }
+
+// staticParamRoutes calls the handler in routes whose key matches the value of the
+// named param, and next when none matches
+func (app *application) staticParamRoutes(param string, routes map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if handler, ok := routes[params.ByName(param)]; ok {
+			handler(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// apiPath returns the given path prefixed with the API base path
+func (app *application) apiPath(path string) string {
+	return app.config.basePath + path
+}
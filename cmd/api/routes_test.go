@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+)
+
+func TestMovieRoutesPermissions(t *testing.T) {
+	routes := []struct {
+		method     string
+		path       string
+		permission string
+	}{
+		{http.MethodGet, "/v1/movies", "movies:read"},
+		{http.MethodGet, "/v1/movies/count", "movies:read"},
+		{http.MethodGet, "/v1/movies/random", "movies:read"},
+		{http.MethodGet, "/v1/movies/suggest?q=moa", "movies:read"},
+		{http.MethodGet, "/v1/movies/" + testMovieID, "movies:read"},
+		{http.MethodGet, "/v1/movies/" + testMovieID + "/history", "movies:read"},
+		{http.MethodGet, "/v1/genres", "movies:read"},
+		{http.MethodPost, "/v1/movies", "movies:write"},
+		{http.MethodPost, "/v1/movies/validate-batch", "movies:write"},
+		{http.MethodPatch, "/v1/movies/" + testMovieID, "movies:write"},
+		{http.MethodDelete, "/v1/movies/" + testMovieID, "movies:write"},
+		{http.MethodPost, "/v1/movies/" + testMovieID + "/publish", "movies:write"},
+		{http.MethodPost, "/v1/movies/" + testMovieID + "/unpublish", "movies:write"},
+		{http.MethodPut, "/v1/movies/external/imdb-tt3521164", "movies:write"},
+	}
+
+	// the user has every movie permission except the one of the route
+	otherPermission := map[string]string{
+		"movies:read":  "movies:write",
+		"movies:write": "movies:read",
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		permissions func(route string) []string
+		wantStatus  int
+	}{
+		{"anonymous", "", func(string) []string { return nil }, http.StatusUnauthorized},
+		{"invalid token", "ZZZZZZZZZZZZZZZZZZZZZZZZZZ", func(string) []string { return nil }, http.StatusUnauthorized},
+		{"without permissions", testToken, func(string) []string { return nil }, http.StatusForbidden},
+		{"with the other permission", testToken, func(route string) []string { return []string{otherPermission[route]} }, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		for _, route := range routes {
+			t.Run(tt.name+" "+route.method+" "+route.path, func(t *testing.T) {
+				// the handlers are never reached, so no movie repository is needed
+				models := data.Models{Users: testUsers(tt.permissions(route.permission)...)}
+
+				ts := newTestServer(t, newTestApplication(t, models))
+
+				res := ts.do(t, route.method, route.path, tt.token, `{}`)
+				if res.status != tt.wantStatus {
+					t.Errorf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+				}
+			})
+		}
+	}
+}
+
+func TestMixedCasePermissionGrant(t *testing.T) {
+	models := data.Models{
+		Movies: testMovies(),
+		Users:  testUsers("Movies:Read"),
+	}
+
+	ts := newTestServer(t, newTestApplication(t, models))
+
+	res := ts.get(t, "/v1/movies/"+testMovieID, testToken)
+	if res.status != http.StatusOK {
+		t.Errorf("got status %d, want %d: %s", res.status, http.StatusOK, res.body)
+	}
+
+	// the grant doesn't give any other permission
+	res = ts.do(t, http.MethodDelete, "/v1/movies/"+testMovieID, testToken, "")
+	if res.status != http.StatusForbidden {
+		t.Errorf("got status %d, want %d: %s", res.status, http.StatusForbidden, res.body)
+	}
+}
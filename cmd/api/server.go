@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -23,12 +24,27 @@ func (app *application) serve() error {
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// HTTP/2 is enabled automatically with TLS, but plaintext internal traffic (like in
+	// a service mesh) needs h2c. We use the native support of the server instead of
+	// wrapping the handler with golang.org/x/net/http2/h2c, because h2c hijacks the
+	// connections and then Shutdown() doesn't wait for them to finish
+	if app.config.server.h2c {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	tlsEnabled := app.config.tls.certFile != ""
+	if tlsEnabled {
+		srv.TLSConfig = app.tlsConfig()
+	}
+
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function
 	shutdownError := make(chan error)
@@ -51,15 +67,36 @@ func (app *application) serve() error {
 		// in the log entry attributes
 		app.logger.Info("shutting down server", "signal", s.String())
 
-		// Create a context with 30-second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		app.draining.Store(true)
+
+		// Create a context with the configured shutdown timeout (30 seconds by default)
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 
-		// Call Shutdown() on the server like before, but now we only send on the
-		// Shutdown channel if it returns an error
+		// report every second how many requests are still being handled, so it's
+		// clear whether the drain is making progress
+		app.logger.Info("draining in-flight requests", "in_flight", app.inFlight.Load())
+		drained := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-drained:
+					return
+				case <-ticker.C:
+					app.logger.Info("draining in-flight requests", "in_flight", app.inFlight.Load())
+				}
+			}
+		}()
+
+		// Call Shutdown() on the server like before. Its error is only sent once the
+		// background tasks are done, as serve() returns after the single receive
 		err := srv.Shutdown(ctx)
+		close(drained)
 		if err != nil {
-			shutdownError <- err
+			app.logger.Warn("requests still in flight after the shutdown timeout", "in_flight", app.inFlight.Load())
 		}
 
 		// Log a message to say that we're waiting for any background goroutines to
@@ -67,11 +104,11 @@ func (app *application) serve() error {
 		app.logger.Info("Completing background tasks", "addr", srv.Addr)
 
 		// Call Wait() to block until our WaitGroup counter is zero ---- essentially
-		// blocking until the background goroutines have finished. Then we return nil on
-		// the shutdownError channel, to indicate that the shutdown completed without
-		// any issues
+		// blocking until the background goroutines have finished. Then we send the
+		// result of Shutdown() on the shutdownError channel, nil when the shutdown
+		// completed without any issues
 		app.wg.Wait()
-		shutdownError <- nil
+		shutdownError <- err
 
 		// Call Shutdown() on our server, passing in the context we just made.
 		// Shutdown() will return nil if the graceful shutdown was successfully or an
@@ -80,13 +117,18 @@ func (app *application) serve() error {
 		// shutdownError <- srv.Shutdown(ctx)
 	}()
 
-	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
+	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env, "h2c", app.config.server.h2c, "tls", tlsEnabled)
 
 	// Calling Shutdown() on our server will cause ListenAndServe() to immediately
 	// return a http.ErrorServerClosed error. So if we see this error, it is actually a
 	// god thing and an indication that the graceful shutdown has started. So we check
 	// specifically for this, only returning the error if its is NOT http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	var err error
+	if tlsEnabled {
+		err = srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -105,3 +147,35 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// tlsVersions are the accepted values of the tls-min-version setting
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the accepted values of the tls-curves setting
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsConfig returns the TLS config of the server. TLS 1.2 only uses the cipher suites
+// Go considers secure (all of them with forward secrecy and AEAD), and TLS 1.3 cipher
+// suites can't be configured, so the only policy knobs are the minimum version and the
+// curves
+func (app *application) tlsConfig() *tls.Config {
+	// the config has already been validated
+	cfg := &tls.Config{
+		MinVersion: tlsVersions[app.config.tls.minVersion],
+	}
+
+	for _, curve := range app.config.tls.curves {
+		cfg.CurvePreferences = append(cfg.CurvePreferences, tlsCurves[curve])
+	}
+
+	return cfg
+}
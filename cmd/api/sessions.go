@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+)
+
+// tokenScopes are the scopes accepted by the token admin endpoints
+var tokenScopes = []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopeEmailChange}
+
+// listTokensHandler returns the active tokens of every user, so admins can look into
+// abuses. The tokens themselves are never returned
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Scope string
+		data.Filters
+	}
+
+	v := app.newValidator(r)
+
+	qs := r.URL.Query()
+
+	err := app.checkQueryParams(r, qs, "scope", "page", "page_size", "sort")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.Scope = app.readString(qs, "scope", "")
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Sort = app.readString(qs, "sort", "expiry")
+	input.SortSafeList = []string{"expiry", "created_at", "-expiry", "-created_at"}
+
+	v.Check(input.Scope == "" || slices.Contains(tokenScopes, input.Scope), "scope", "invalid scope value")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	sessions, metadata, err := app.modelsFor(r).Tokens.GetAllFiltered(input.Scope, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"tokens": sessions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeTokensHandler deletes every token of a user, of a scope, or of a scope of a
+// user
+func (app *application) revokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID string `json:"user_id"`
+		Scope  string `json:"scope"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	v.Check(input.UserID != "" || input.Scope != "", "user_id", "must be provided when scope is not")
+	v.Check(input.UserID == "" || validator.IsUUID(input.UserID), "user_id", "must be a valid user ID")
+	v.Check(input.Scope == "" || slices.Contains(tokenScopes, input.Scope), "scope", "invalid scope value")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	count, err := app.modelsFor(r).Tokens.DeleteAllFiltered(input.UserID, input.Scope)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordAudit(r, app.requestActorID(r), data.AuditTokensRevoke, input.UserID, map[string]any{"scope": input.Scope, "revoked": count})
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"revoked": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
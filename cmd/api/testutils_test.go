@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/data/mocks"
+	"github.com/giancarlosisasi/greenlight-api/internal/mailer"
+	"github.com/jackc/pgx/v5"
+)
+
+// testToken is the authentication token accepted by the users of testUsers()
+const testToken = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// testUserID is the ID of the user authenticated with testToken
+const testUserID = "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f80"
+
+// testConfig returns the config used by the tests, with the defaults of the flags
+// that matter to the handlers
+func testConfig() config {
+	var cfg config
+
+	cfg.env = "development"
+	cfg.basePath = "/v1"
+	cfg.timezone = "UTC"
+	cfg.timezoneLocation = time.UTC
+	cfg.editConflictRetries = 3
+	cfg.maxTokensPerUser = 10
+	cfg.movieSort = "id"
+	cfg.cors.allowedMethods = []string{"OPTIONS", "PUT", "PATCH", "DELETE"}
+	cfg.cors.allowedHeaders = []string{"Authorization", "Content-Type"}
+	cfg.healthcheck.timeout = time.Second
+
+	return cfg
+}
+
+// newTestApplication returns an application using the given models, also inside the
+// transactions of withTx(), and a mailer which records the emails instead of sending
+// them. The features keep their default states unless models has Features. The logs
+// are discarded
+func newTestApplication(t *testing.T, models data.Models) *application {
+	t.Helper()
+
+	if models.Features == nil {
+		models.Features = &mocks.FeatureFlagModel{
+			GetAllFunc: func() (map[string]*data.FeatureFlag, error) {
+				return map[string]*data.FeatureFlag{}, nil
+			},
+		}
+	}
+
+	app := &application{
+		config:   testConfig(),
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models:   models,
+		db:       testDB{},
+		mailer:   newTestMailer(),
+		txModels: func(tx pgx.Tx) data.Models { return models },
+	}
+
+	// the emails are sent in the background, they must be done before the next test
+	t.Cleanup(app.wg.Wait)
+
+	return app
+}
+
+// testUsers returns a fake user repository which authenticates testToken as an
+// activated user with the given permissions
+func testUsers(permissions ...string) *mocks.UserModel {
+	return &mocks.UserModel{
+		GetForTokenWithPermissionsFunc: func(tokenScope string, tokenPlainText string) (*data.User, data.Permissions, *data.Token, error) {
+			if tokenScope != data.ScopeAuthentication || tokenPlainText != testToken {
+				return nil, nil, nil, data.ErrRecordNotFound
+			}
+
+			user := &data.User{ID: testUserID, Name: "Alice", Email: "alice@example.com", Activated: true}
+			token := &data.Token{UserID: testUserID, Scope: tokenScope, Expiry: time.Now().Add(time.Hour), CreatedAt: time.Now()}
+
+			return user, data.Permissions(permissions), token, nil
+		},
+	}
+}
+
+// testDB starts fake transactions, the queries are run by the models of
+// application.txModels
+type testDB struct{}
+
+func (testDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	return testTx{}, nil
+}
+
+// testTx is a fake transaction, calling any method other than Commit and Rollback
+// panics
+type testTx struct {
+	pgx.Tx
+}
+
+func (testTx) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (testTx) Rollback(ctx context.Context) error {
+	return pgx.ErrTxClosed
+}
+
+// testEmail is an email recorded by testMailer
+type testEmail struct {
+	Locale       string
+	Recipient    string
+	TemplateFile string
+	Data         any
+}
+
+// testMailer renders the emails like the real mailer but records them instead of
+// sending them
+type testMailer struct {
+	*mailer.Mailer
+
+	mu   sync.Mutex
+	sent []testEmail
+	// err is returned by Send, which records nothing when it's set
+	err error
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{Mailer: mailer.NewDialer("localhost", 25, "", "", "test@example.com", 1)}
+}
+
+func (m *testMailer) Send(locale string, recipient string, templateFile string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.sent = append(m.sent, testEmail{Locale: locale, Recipient: recipient, TemplateFile: templateFile, Data: data})
+
+	return nil
+}
+
+func (m *testMailer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// testServer serves the whole middleware chain of app.routes()
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, app *application) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// testResponse is a response read by testServer.do()
+type testResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// decode unmarshals the JSON body of the response into dst
+func (res testResponse) decode(t *testing.T, dst any) {
+	t.Helper()
+
+	err := json.Unmarshal(res.body, dst)
+	if err != nil {
+		t.Fatalf("unable to decode the response body %q: %v", res.body, err)
+	}
+}
+
+// fieldErrors returns the fields of a validation error response
+func (res testResponse) fieldErrors(t *testing.T) map[string]string {
+	t.Helper()
+
+	var body struct {
+		Error struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"error"`
+	}
+	res.decode(t, &body)
+
+	return body.Error.Fields
+}
+
+// do sends a request to the server, authenticated with token when it isn't empty, and
+// with body as its JSON body when it isn't empty
+func (ts *testServer) do(t *testing.T, method string, path string, token string, body string) testResponse {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = bytes.NewBufferString(body)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testResponse{status: res.StatusCode, headers: res.Header, body: resBody}
+}
+
+// get sends a GET request authenticated with token when it isn't empty
+func (ts *testServer) get(t *testing.T, path string, token string) testResponse {
+	t.Helper()
+
+	return ts.do(t, http.MethodGet, path, token, "")
+}
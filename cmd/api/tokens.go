@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
-	"github.com/giancarlosisasi/greenlight-api/internal/validator"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -23,20 +22,20 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	// validate the email and password provided by the client
-	v := validator.New()
+	v := app.newValidator(r)
 
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlainText(v, input.Password)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
 	// Lookup the user record based on the email address. If not matching user was
 	// found, them call the app.invalidCredentialResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment)
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -58,13 +57,29 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// make room for the new token before creating it, so the user never has more
+	// active tokens than the configured maximum
+	if app.config.maxTokensPerUser > 0 {
+		err = app.modelsFor(r).Tokens.DeleteOldestForUser(data.ScopeAuthentication, user.ID, app.config.maxTokensPerUser-1)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// with sliding sessions, tokens expire after the sliding window of inactivity
+	ttl := 24 * time.Hour
+	if app.config.tokens.slidingWindow > 0 {
+		ttl = app.config.tokens.slidingWindow
+	}
+
+	token, err := app.modelsFor(r).Tokens.New(user.ID, ttl, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJson(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJson(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
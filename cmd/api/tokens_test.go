@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/data/mocks"
+)
+
+func TestCreateAuthenticationToken(t *testing.T) {
+	user := &data.User{ID: testUserID, Name: "Alice", Email: "alice@example.com", Activated: true}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.Models{
+		Users: &mocks.UserModel{
+			GetByEmailFunc: func(email string) (*data.User, error) {
+				if email != user.Email {
+					return nil, data.ErrRecordNotFound
+				}
+				return user, nil
+			},
+		},
+		Tokens: &mocks.TokenModel{
+			DeleteOldestForUserFunc: func(scope string, userID string, keep int) error {
+				return nil
+			},
+			NewFunc: func(userID string, ttl time.Duration, scope string) (*data.Token, error) {
+				return &data.Token{Plaintext: testToken, UserID: userID, Scope: scope, Expiry: time.Now().Add(ttl)}, nil
+			},
+		},
+	}
+
+	ts := newTestServer(t, newTestApplication(t, models))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid credentials", `{"email": "alice@example.com", "password": "pa55word1234"}`, http.StatusCreated},
+		{"wrong password", `{"email": "alice@example.com", "password": "wrong-password"}`, http.StatusUnauthorized},
+		{"unknown email", `{"email": "bob@example.com", "password": "pa55word1234"}`, http.StatusUnauthorized},
+		{"invalid email", `{"email": "alice", "password": "pa55word1234"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", tt.body)
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var body struct {
+				AuthenticationToken struct {
+					Token string `json:"token"`
+				} `json:"authentication_token"`
+			}
+			res.decode(t, &body)
+
+			if body.AuthenticationToken.Token != testToken {
+				t.Errorf("got token %q, want %q", body.AuthenticationToken.Token, testToken)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/giancarlosisasi/greenlight-api/internal/data"
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/jackc/pgx/v5"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,10 +23,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// When activation isn't required the user is created already activated. Users
+	// created while it was required still need to activate their accounts, since
+	// requireActivatedUser() only looks at the stored Activated value
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: false,
+		Activated: !app.config.activationRequired,
 	}
 
 	err = user.Password.Set(input.Password)
@@ -34,20 +38,23 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	v := validator.New()
+	v := app.newValidator(r)
 
-	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	data.ValidateUser(v, user)
+	data.ValidatePasswordStrength(v, app.config.passwordPolicy, input.Password, input.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
 	// insert the use data into the db
-	err = app.models.Users.Insert(user)
+	err = app.modelsFor(r).Users.Insert(user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicatedEmail):
 			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 
@@ -56,37 +63,38 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	err = app.modelsFor(r).Permissions.AddForUser(user.ID, "movies:read")
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if !app.config.activationRequired {
+		err = app.writeJson(w, r, http.StatusCreated, envelope{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	// after the user record has been created in the database, generate a new
 	// activation token for the user
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.modelsFor(r).Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// Importantly, if there is an error sending the email then we use the
-			// app.logger.Error() helper to manage it, instead of the
-			// app.serverErrorResponse() helper like before
-			app.logger.Error(err.Error())
-		}
+	// the email is written in the language of the request, failed sends are retried
+	// and recorded in the failed_tasks table
+	app.sendEmail(app.contextGetLocale(r), user.ID, user.Email, "user_welcome.tmpl", map[string]any{
+		"activationToken": token.Plaintext,
+		"userID":          user.ID,
+		"basePath":        app.config.basePath,
+		"activationURL":   app.frontendURL(app.config.frontend.activationPath, token.Plaintext),
 	})
 
-	err = app.writeJson(w, http.StatusCreated, envelope{"user": user}, nil)
+	err = app.writeJson(w, r, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -104,20 +112,20 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	v := validator.New()
+	v := app.newValidator(r)
 
 	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -125,9 +133,146 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	user.Activated = true
-	err = app.models.Users.Update(user)
+	err = app.modelsFor(r).Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the user activates their own account with the token, so they are the actor
+	app.recordAudit(r, user.ID, data.AuditUserActivate, user.ID, map[string]any{"activated": true})
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := app.newValidator(r)
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Email != user.Email, "email", "must be different from the current email address")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// check the new address isn't used by another account before sending the
+	// confirmation email. The unique constraint is checked again when the change is
+	// confirmed, in case the address was taken in the meantime
+	_, err = app.modelsFor(r).Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// only the latest email change request can be confirmed
+	err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.modelsFor(r).Tokens.NewEmailChange(user.ID, 24*time.Hour, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the confirmation email is sent to the NEW address, this way we verify that the
+	// user owns it before changing anything
+	app.sendEmail(app.contextGetLocale(r), user.ID, input.Email, "email_change.tmpl", map[string]any{
+		"emailChangeToken": token.Plaintext,
+		"basePath":         app.config.basePath,
+		"emailChangeURL":   app.frontendURL(app.config.frontend.emailChangePath, token.Plaintext),
+	})
+
+	err = app.writeJson(w, r, http.StatusAccepted, envelope{"message": "an email will be sent to the new address containing the confirmation instructions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if data.ValidateTokenPlainText(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	pendingEmail, err := app.modelsFor(r).Tokens.GetPendingEmail(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = pendingEmail
+	err = app.modelsFor(r).Users.Update(user)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicatedEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -136,15 +281,259 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeJson(w, r, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) resendActivationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// We always send the same 202 Accepted response, whether the user exists, is
+	// already activated or not, so this endpoint can't be used to find out which
+	// email addresses are registered
+	message := envelope{"message": "if the email address belongs to an account pending activation, an email will be sent to it containing the activation instructions"}
+
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJson(w, r, http.StatusAccepted, message, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
+
+	if !user.Activated {
+		// only the latest activation token is valid
+		err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.modelsFor(r).Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.sendEmail(app.contextGetLocale(r), user.ID, user.Email, "token_activation.tmpl", map[string]any{
+			"activationToken": token.Plaintext,
+			"basePath":        app.config.basePath,
+			"activationURL":   app.frontendURL(app.config.frontend.activationPath, token.Plaintext),
+		})
+	}
+
+	err = app.writeJson(w, r, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxImportUsers is the maximum number of users created by a single import. It's much
+// lower than maxValidateBatch because every plain text password has to be hashed
+const maxImportUsers = 100
+
+// importUsersHandler creates the given users, e.g. when migrating from another system.
+// Each user has either a temporary plain text password or a password hash made by one
+// of the supported algorithms. The users which are invalid or whose email address is
+// already taken are reported and skipped, the rest are created in a single transaction
+func (app *application) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Users []struct {
+			Name         string  `json:"name"`
+			Email        string  `json:"email"`
+			Password     *string `json:"password"`
+			PasswordHash *string `json:"password_hash"`
+			Activated    bool    `json:"activated"`
+		} `json:"users"`
+		// SendWelcomeEmail sends the welcome email to the created users, along with an
+		// activation token to those who aren't activated
+		SendWelcomeEmail bool `json:"send_welcome_email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := app.newValidator(r)
+
+	v.Check(len(input.Users) >= 1, "users", "must contain at least 1 user")
+	v.Check(len(input.Users) <= maxImportUsers, "users", v.Sprintf("must not contain more than %d users", maxImportUsers))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	type result struct {
+		Index  int                   `json:"index"`
+		Status string                `json:"status"`
+		User   *data.User            `json:"user,omitempty"`
+		Errors validator.FieldErrors `json:"errors,omitzero"`
+	}
+
+	results := make([]result, len(input.Users))
+	users := make([]*data.User, len(input.Users))
+
+	for i, row := range input.Users {
+		results[i] = result{Index: i}
+
+		user := &data.User{
+			Name:      row.Name,
+			Email:     row.Email,
+			Activated: row.Activated,
+		}
+
+		v := app.newValidator(r)
+
+		switch {
+		case row.Password != nil && row.PasswordHash != nil:
+			v.AddError("password", "must not be provided along with password_hash")
+		case row.Password != nil:
+			err = user.Password.Set(*row.Password)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		case row.PasswordHash != nil:
+			if user.Password.SetHash(*row.PasswordHash) != nil {
+				v.AddError("password_hash", "must be a bcrypt or argon2id hash")
+			}
+		default:
+			v.AddError("password", "must be provided")
+		}
+
+		// ValidateUser() needs the password to be set
+		if v.Valid() {
+			data.ValidateUser(v, user)
+		}
+
+		if !v.Valid() {
+			results[i].Status = "invalid"
+			results[i].Errors = v.FieldErrors()
+			continue
+		}
+
+		users[i] = user
+	}
+
+	actorID := app.requestActorID(r)
+	// the activation tokens of the welcome emails, by user index
+	tokens := make(map[int]*data.Token)
+
+	err = app.withTx(r.Context(), func(tx pgx.Tx) error {
+		models := app.modelsForTx(tx)
+
+		for i, user := range users {
+			if user == nil {
+				continue
+			}
+
+			// InsertIfNew() doesn't abort the transaction when the email address is
+			// taken, by another user or by a previous row of the import
+			err := models.Users.InsertIfNew(user)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrDuplicatedEmail):
+					v := app.newValidator(r)
+					v.AddError("email", "a user with this email address already exists")
+					results[i].Status = "duplicate"
+					results[i].Errors = v.FieldErrors()
+					users[i] = nil
+					continue
+				default:
+					return err
+				}
+			}
+
+			err = models.Permissions.AddForUser(user.ID, "movies:read")
+			if err != nil {
+				return err
+			}
+
+			err = models.Audit.Record(actorID, data.AuditUserImport, user.ID, map[string]any{"activated": user.Activated})
+			if err != nil {
+				return err
+			}
+
+			if input.SendWelcomeEmail && !user.Activated {
+				tokens[i], err = models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	created := 0
+	for i, user := range users {
+		if user == nil {
+			continue
+		}
+
+		results[i].Status = "created"
+		results[i].User = user
+		created++
+
+		if !input.SendWelcomeEmail {
+			continue
+		}
+
+		templateData := map[string]any{
+			"userID":    user.ID,
+			"activated": user.Activated,
+			"basePath":  app.config.basePath,
+		}
+		if token, ok := tokens[i]; ok {
+			templateData["activationToken"] = token.Plaintext
+			templateData["activationURL"] = app.frontendURL(app.config.frontend.activationPath, token.Plaintext)
+		}
+
+		app.sendEmail(app.contextGetLocale(r), user.ID, user.Email, "user_welcome.tmpl", templateData)
+	}
+
+	err = app.writeJson(w, r, http.StatusOK, envelope{
+		"results": results,
+		"created": created,
+		"skipped": len(results) - created,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,121 @@
+// Command seed bootstraps a database: it creates the permission codes used by the
+// API and, when SEED_ADMIN_EMAIL is set, an activated admin user with all of them.
+// It's safe to run it more than once.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Print("Error loading the .env file")
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	err = run(logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	defer db.Close()
+
+	err = db.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the database: %w", err)
+	}
+
+	// same env var as the password-hash setting of the API
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		err = data.SetPasswordHashAlgorithm(algorithm)
+		if err != nil {
+			return err
+		}
+	}
+
+	models := data.NewModels(db)
+
+	created, err := models.Permissions.Insert(data.PermissionCodes...)
+	if err != nil {
+		return fmt.Errorf("unable to seed the permissions: %w", err)
+	}
+	logger.Info("permissions seeded", "created", created, "codes", len(data.PermissionCodes))
+
+	email := os.Getenv("SEED_ADMIN_EMAIL")
+	if email == "" {
+		return nil
+	}
+
+	return seedAdmin(logger, models, email)
+}
+
+// seedAdmin creates the admin user with the SEED_ADMIN_NAME and SEED_ADMIN_PASSWORD
+// env vars, unless a user with that email already exists, and grants it every
+// permission
+func seedAdmin(logger *slog.Logger, models data.Models, email string) error {
+	user, err := models.Users.GetByEmail(email)
+	switch {
+	case err == nil:
+		logger.Info("admin user already exists", "email", email)
+	case errors.Is(err, data.ErrRecordNotFound):
+		name := os.Getenv("SEED_ADMIN_NAME")
+		if name == "" {
+			name = "Admin"
+		}
+
+		user = &data.User{
+			Name:      name,
+			Email:     email,
+			Activated: true,
+		}
+
+		err = user.Password.Set(os.Getenv("SEED_ADMIN_PASSWORD"))
+		if err != nil {
+			return err
+		}
+
+		v := validator.New()
+		if data.ValidateUser(v, user); !v.Valid() {
+			return fmt.Errorf("invalid admin user: %v", v.Errors)
+		}
+
+		err = models.Users.Insert(user)
+		if err != nil {
+			return fmt.Errorf("unable to create the admin user: %w", err)
+		}
+		logger.Info("admin user created", "email", email)
+	default:
+		return err
+	}
+
+	err = models.Permissions.AddForUser(user.ID, data.PermissionCodes...)
+	if err != nil {
+		return fmt.Errorf("unable to grant the admin permissions: %w", err)
+	}
+	logger.Info("admin permissions granted", "email", email)
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+	"github.com/jackc/pgx/v5"
+)
+
+// APIKeyPrefix starts every API key, so they can be told apart from the user
+// authentication tokens sent in the same Authorization header
+const APIKeyPrefix = "glk_"
+
+// APIKey is a long-lived credential for server to server integrations. It acts on
+// behalf of the user who owns it, but only with its own set of permissions, and it
+// stays valid until it's revoked
+type APIKey struct {
+	ID          string      `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	OwnerID     string      `json:"owner_id"`
+	Permissions Permissions `json:"permissions"`
+	RevokedAt   *time.Time  `json:"revoked_at,omitempty"`
+	// Plaintext is only set when the key is created, it can't be recovered later
+	Plaintext string `json:"-"`
+	Hash      []byte `json:"-"`
+}
+
+// IsAPIKey reports whether the bearer credential is an API key
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission code")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicated values")
+}
+
+type APIKeyModel struct {
+	DB DB
+}
+
+func NewAPIKeyModel(db DB) *APIKeyModel {
+	return &APIKeyModel{
+		DB: db,
+	}
+}
+
+// Insert generates the plaintext of the key and stores its hash
+func (m *APIKeyModel) Insert(key *APIKey) error {
+	key.Plaintext = APIKeyPrefix + rand.Text()
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	query := `
+		INSERT INTO api_keys (name, hash, owner_id, permissions)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, key.Name, key.Hash, key.OwnerID, key.Permissions).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAll returns every API key, including the revoked ones, newest first
+func (m *APIKeyModel) GetAll() ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, name, owner_id, permissions, revoked_at
+		FROM api_keys
+		ORDER BY created_at DESC, id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(&key.ID, &key.CreatedAt, &key.Name, &key.OwnerID, &key.Permissions, &key.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Revoke revokes the API key with the given ID. It returns ErrRecordNotFound when the
+// key doesn't exist or it's already revoked
+func (m *APIKeyModel) Revoke(id string) error {
+	query := `
+		UPDATE api_keys
+		SET revoked_at = now()
+		WHERE id = $1 AND revoked_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetOwnerForKey returns the owner of a valid API key and the permissions of the key
+func (m *APIKeyModel) GetOwnerForKey(plaintext string) (*User, Permissions, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.rate_limit_rps, users.rate_limit_burst, api_keys.permissions
+		FROM api_keys
+		INNER JOIN users
+		ON users.id = api_keys.owner_id
+		WHERE api_keys.hash = $1
+		AND api_keys.revoked_at IS NULL
+	`
+
+	var user User
+	var permissions Permissions
+	var rps *float64
+	var burst *int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, hash[:]).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&rps,
+		&burst,
+		&permissions,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	user.RateLimit = rateLimitOverride(rps, burst)
+
+	return &user, permissions, nil
+}
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The actions recorded in the audit log
+const (
+	AuditUserActivate      = "user.activate"
+	AuditUserImport        = "user.import"
+	AuditPermissionsGrant  = "permissions.grant"
+	AuditPermissionsRevoke = "permissions.revoke"
+	AuditMovieDelete       = "movie.delete"
+	AuditAPIKeyCreate      = "api_key.create"
+	AuditAPIKeyRevoke      = "api_key.revoke"
+	AuditTokensRevoke      = "tokens.revoke"
+	AuditFeatureSet        = "feature.set"
+	AuditReadOnlySet       = "read_only.set"
+)
+
+// AuditEntry is a record of a sensitive operation. ActorID is empty when the actor
+// is unknown or its user has been deleted
+type AuditEntry struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	ActorID   string         `json:"actor_id,omitzero"`
+	Action    string         `json:"action"`
+	Target    string         `json:"target"`
+	Changes   map[string]any `json:"changes"`
+}
+
+// AuditModel works with the audit_log table, which is append-only: entries are never
+// updated nor deleted
+type AuditModel struct {
+	DB DB
+}
+
+func NewAuditModel(db DB) *AuditModel {
+	return &AuditModel{
+		DB: db,
+	}
+}
+
+// Record appends an entry to the audit log. actorID can be empty when the actor is
+// unknown
+func (m AuditModel) Record(actorID string, action string, target string, changes map[string]any) error {
+	query := `
+		INSERT INTO audit_log (actor_id, action, target, changes)
+		VALUES (NULLIF($1, '')::uuid, $2, $3, $4)
+	`
+
+	if changes == nil {
+		changes = map[string]any{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, actorID, action, target, changes)
+	return err
+}
+
+// GetAll returns the audit log entries, optionally filtered by actor and action (empty
+// strings match everything)
+func (m AuditModel) GetAll(actorID string, action string, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, COALESCE(actor_id::text, ''), action, target, changes
+		FROM audit_log
+		WHERE (actor_id = NULLIF($1, '')::uuid OR $1 = '')
+		AND (action = $2 OR $2 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4
+	`, filters.getSortColumn(), filters.getSortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, actorID, action, filters.getLimit(), filters.getOffSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.Target,
+			&entry.Changes,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrCircuitOpen is returned without querying the database while the circuit breaker
+// is open
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// BreakerDB wraps a DB with a circuit breaker. After Threshold consecutive database
+// failures the breaker opens and every query fails fast with ErrCircuitOpen during
+// the Cooldown period. Then it half-opens and lets a single query through to test
+// if the database recovered: if it succeeds the breaker closes, otherwise it opens
+// again for another cooldown period.
+type BreakerDB struct {
+	DB        DB
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func NewBreakerDB(db DB, threshold int, cooldown time.Duration) *BreakerDB {
+	return &BreakerDB{
+		DB:        db,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+func (db *BreakerDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if err := db.allow(); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	tag, err := db.DB.Exec(ctx, sql, args...)
+	db.record(err)
+
+	return tag, err
+}
+
+func (db *BreakerDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := db.allow(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.DB.Query(ctx, sql, args...)
+	if err != nil {
+		db.record(err)
+		return nil, err
+	}
+
+	return &breakerRows{Rows: rows, db: db}, nil
+}
+
+// breakerRows reports the outcome of the query to the breaker once the rows have been
+// read, because the errors of a query may only show up while iterating its rows. It's
+// reported by Err(), which is called after the rows.Next() loop, or by Close() when
+// Err() isn't called
+type breakerRows struct {
+	pgx.Rows
+	db       *BreakerDB
+	recorded bool
+}
+
+func (r *breakerRows) Err() error {
+	err := r.Rows.Err()
+	r.record(err)
+
+	return err
+}
+
+func (r *breakerRows) Close() {
+	r.Rows.Close()
+	r.record(r.Rows.Err())
+}
+
+func (r *breakerRows) record(err error) {
+	if r.recorded {
+		return
+	}
+
+	r.recorded = true
+	r.db.record(err)
+}
+
+func (db *BreakerDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &breakerRow{db: db, row: func() pgx.Row { return db.DB.QueryRow(ctx, sql, args...) }}
+}
+
+type breakerRow struct {
+	db  *BreakerDB
+	row func() pgx.Row
+}
+
+func (r *breakerRow) Scan(dest ...any) error {
+	if err := r.db.allow(); err != nil {
+		return err
+	}
+
+	err := r.row().Scan(dest...)
+	r.db.record(err)
+
+	return err
+}
+
+// State returns the current state of the breaker: closed, open or half-open
+func (db *BreakerDB) State() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.state
+}
+
+func (db *BreakerDB) allow() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch db.state {
+	case breakerOpen:
+		if time.Since(db.openedAt) < db.Cooldown {
+			return ErrCircuitOpen
+		}
+		// the cooldown is over, so this query is used to test the database
+		db.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// a test query is already in flight
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+func (db *BreakerDB) record(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !isDatabaseFailure(err) {
+		db.state = breakerClosed
+		db.failures = 0
+		return
+	}
+
+	db.failures++
+
+	if db.state == breakerHalfOpen || db.failures >= db.Threshold {
+		db.state = breakerOpen
+		db.openedAt = time.Now()
+	}
+}
+
+// isDatabaseFailure reports whether the error means the database is unavailable. No
+// rows, constraint violations and any other error returned by the server for the
+// query itself prove that the database is up, and a client canceling its request or
+// a busy connection pool say nothing about the database.
+func isDatabaseFailure(err error) bool {
+	if err == nil || errors.Is(err, pgx.ErrNoRows) || errors.Is(err, context.Canceled) || errors.Is(err, ErrPoolBusy) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return IsTransientError(err)
+	}
+
+	return true
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeRows are rows without any row, failing with err once they are read
+type fakeRows struct {
+	pgx.Rows
+	err error
+}
+
+func (r *fakeRows) Next() bool { return false }
+func (r *fakeRows) Err() error { return r.err }
+func (r *fakeRows) Close()     {}
+
+// rowsDB is a DB whose queries start fine and fail with err while reading their rows
+type rowsDB struct {
+	fakeDB
+	err error
+}
+
+func (db *rowsDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return &fakeRows{err: db.err}, nil
+}
+
+func TestBreakerDBQueryRowsErrors(t *testing.T) {
+	connectionReset := &pgconn.PgError{Code: "08006"}
+
+	tests := []struct {
+		name      string
+		err       error
+		readErr   bool
+		wantState string
+	}{
+		{"rows read without errors", nil, true, breakerClosed},
+		{"rows failing, reported by Err", connectionReset, true, breakerOpen},
+		{"rows failing, reported by Close", connectionReset, false, breakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewBreakerDB(&rowsDB{err: tt.err}, 1, time.Minute)
+
+			rows, err := db.Query(context.Background(), "SELECT 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for rows.Next() {
+			}
+			if tt.readErr && !errors.Is(rows.Err(), tt.err) {
+				t.Errorf("got rows error %v, want %v", rows.Err(), tt.err)
+			}
+			rows.Close()
+
+			if state := db.State(); state != tt.wantState {
+				t.Errorf("got state %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
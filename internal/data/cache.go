@@ -0,0 +1,112 @@
+package data
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// movieCache is a fixed size LRU cache of movies, safe for concurrent use. Entries
+// expire after the ttl, and an entry is never replaced by an older version of the
+// same movie, so a slow read can't overwrite the result of a more recent update.
+type movieCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type movieCacheEntry struct {
+	movie     Movie
+	expiresAt time.Time
+}
+
+func newMovieCache(size int, ttl time.Duration) *movieCache {
+	return &movieCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached movie, so callers can modify it freely
+func (c *movieCache) get(id string) (*Movie, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[id]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*movieCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	c.hits.Add(1)
+
+	return copyMovie(&entry.movie), true
+}
+
+func (c *movieCache) set(movie *Movie) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &movieCacheEntry{movie: *copyMovie(movie), expiresAt: time.Now().Add(c.ttl)}
+
+	if elem, ok := c.items[movie.ID]; ok {
+		if elem.Value.(*movieCacheEntry).movie.Version > movie.Version {
+			return
+		}
+
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[movie.ID] = c.ll.PushFront(entry)
+
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *movieCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[id]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *movieCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*movieCacheEntry).movie.ID)
+}
+
+func (c *movieCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func copyMovie(movie *Movie) *Movie {
+	movieCopy := *movie
+	movieCopy.Genres = slices.Clone(movie.Genres)
+
+	return &movieCopy
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DB is the subset of the *pgxpool.Pool methods used by the models. It's also
+// satisfied by pgx.Tx, and it allows us to wrap the pool with extra behavior (like
+// retries) or to replace it with a fake one
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// RetryDB wraps a DB and retries the queries that fail with a transient error, like
+// a connection reset or a server restart
+type RetryDB struct {
+	DB       DB
+	Attempts int
+	Backoff  time.Duration
+}
+
+func NewRetryDB(db DB, attempts int, backoff time.Duration) *RetryDB {
+	return &RetryDB{
+		DB:       db,
+		Attempts: attempts,
+		Backoff:  backoff,
+	}
+}
+
+func (db *RetryDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+
+	err := db.retry(ctx, func() error {
+		var err error
+		tag, err = db.DB.Exec(ctx, sql, args...)
+		return err
+	})
+
+	return tag, err
+}
+
+func (db *RetryDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	var rows pgx.Rows
+
+	err := db.retry(ctx, func() error {
+		var err error
+		rows, err = db.DB.Query(ctx, sql, args...)
+		return err
+	})
+
+	return rows, err
+}
+
+// QueryRow defers the query until Scan() is called, because pgx only reports the
+// QueryRow() errors when scanning the row
+func (db *RetryDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &retryRow{db: db, ctx: ctx, sql: sql, args: args}
+}
+
+type retryRow struct {
+	db   *RetryDB
+	ctx  context.Context
+	sql  string
+	args []any
+}
+
+func (r *retryRow) Scan(dest ...any) error {
+	return r.db.retry(r.ctx, func() error {
+		return r.db.DB.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
+
+func (db *RetryDB) retry(ctx context.Context, fn func() error) error {
+	attempts := max(db.Attempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsTransientError(err) || attempt >= attempts {
+			return err
+		}
+
+		// exponential backoff: 1x, 2x, 4x... the configured backoff
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(db.Backoff << (attempt - 1)):
+		}
+	}
+}
+
+// IsTransientError reports whether the error is a temporary database problem that
+// is safe to retry. Context cancellations, timeouts and errors returned by the
+// server for the query itself (like constraint violations) are never transient.
+func IsTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		// class 08: connection exception
+		case len(pgErr.Code) == 5 && pgErr.Code[:2] == "08":
+			return true
+		// admin_shutdown, crash_shutdown and cannot_connect_now are returned while
+		// the server is restarting
+		case pgErr.Code == "57P01", pgErr.Code == "57P02", pgErr.Code == "57P03":
+			return true
+		// serialization_failure and deadlock_detected
+		case pgErr.Code == "40001", pgErr.Code == "40P01":
+			return true
+		default:
+			return false
+		}
+	}
+
+	// SafeToRetry() returns true when the error happened before any data was sent
+	// to the server, so the query was never executed
+	return pgconn.SafeToRetry(err)
+}
+
+// IsTimeoutError reports whether the query was aborted because it took too long,
+// either because the context deadline was exceeded or because the server canceled
+// it after its statement_timeout
+func IsTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// query_canceled
+		return pgErr.Code == "57014"
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeDB is a DB whose queries fail with the errors of errs, one per call, and
+// succeed once they run out
+type fakeDB struct {
+	errs  []error
+	calls int
+}
+
+func (db *fakeDB) next() error {
+	db.calls++
+
+	if len(db.errs) == 0 {
+		return nil
+	}
+
+	err := db.errs[0]
+	db.errs = db.errs[1:]
+
+	return err
+}
+
+func (db *fakeDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return pgconn.NewCommandTag("UPDATE 1"), db.next()
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, db.next()
+}
+
+func (db *fakeDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return fakeRow{err: db.next()}
+}
+
+type fakeRow struct {
+	err error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	return r.err
+}
+
+func TestRetryDB(t *testing.T) {
+	connectionReset := &pgconn.PgError{Code: "08006"}
+	uniqueViolation := &pgconn.PgError{Code: "23505"}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{"success", nil, nil, 1},
+		{"fails once then succeeds", []error{connectionReset}, nil, 2},
+		{"fails every attempt", []error{connectionReset, connectionReset, connectionReset}, connectionReset, 3},
+		{"constraint violation", []error{uniqueViolation}, uniqueViolation, 1},
+		{"context canceled", []error{context.Canceled}, context.Canceled, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each method of the DB goes through the retries
+			queries := map[string]func(db DB) error{
+				"Exec": func(db DB) error {
+					_, err := db.Exec(context.Background(), "UPDATE movies SET title = 'x'")
+					return err
+				},
+				"Query": func(db DB) error {
+					_, err := db.Query(context.Background(), "SELECT 1")
+					return err
+				},
+				"QueryRow": func(db DB) error {
+					return db.QueryRow(context.Background(), "SELECT 1").Scan()
+				},
+			}
+
+			for method, query := range queries {
+				fake := &fakeDB{errs: append([]error(nil), tt.errs...)}
+
+				err := query(NewRetryDB(fake, 3, 0))
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("%s: got error %v, want %v", method, err, tt.wantErr)
+				}
+				if fake.calls != tt.wantCalls {
+					t.Errorf("%s: got %d calls, want %d", method, fake.calls, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
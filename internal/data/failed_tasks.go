@@ -0,0 +1,39 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// FailedTask is a background task which kept failing after all of its attempts. The
+// failed_tasks table is a dead letter log, the tasks aren't retried from it
+type FailedTask struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Task      string    `json:"task"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+}
+
+type FailedTaskModel struct {
+	DB DB
+}
+
+func NewFailedTaskModel(db DB) *FailedTaskModel {
+	return &FailedTaskModel{
+		DB: db,
+	}
+}
+
+func (m FailedTaskModel) Insert(task *FailedTask) error {
+	query := `
+		INSERT INTO failed_tasks (task, attempts, error)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, task.Task, task.Attempts, task.Error).Scan(&task.ID, &task.CreatedAt)
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// FeatureFlag is the state of a feature set by an admin. The features without a row
+// in the feature_flags table have the default state defined in the code
+type FeatureFlag struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+}
+
+type FeatureFlagModel struct {
+	DB DB
+}
+
+func NewFeatureFlagModel(db DB) *FeatureFlagModel {
+	return &FeatureFlagModel{
+		DB: db,
+	}
+}
+
+// GetAll returns the states set by the admins, keyed by the name of the feature
+func (m FeatureFlagModel) GetAll() (map[string]*FeatureFlag, error) {
+	query := `
+		SELECT name, enabled, updated_at
+		FROM feature_flags
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make(map[string]*FeatureFlag)
+
+	for rows.Next() {
+		var flag FeatureFlag
+
+		err := rows.Scan(&flag.Name, &flag.Enabled, &flag.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		flags[flag.Name] = &flag
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return flags, nil
+}
+
+// Set stores the state of the feature, overriding its default state
+func (m FeatureFlagModel) Set(flag *FeatureFlag) error {
+	query := `
+		INSERT INTO feature_flags (name, enabled)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = NOW()
+		RETURNING updated_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, flag.Name, flag.Enabled).Scan(&flag.UpdatedAt)
+}
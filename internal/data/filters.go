@@ -1,11 +1,15 @@
 package data
 
 import (
+	"context"
 	"strings"
+	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
 )
 
+// Filters are the pagination and sort of a list. Every list query breaks the ties of
+// the sort column with a unique column, so the pages are stable
 type Filters struct {
 	Page         int
 	PageSize     int
@@ -53,22 +57,22 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(validator.PermittedValues(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
 }
 
+// Metadata is the pagination metadata of a list. Every field is always present, even
+// when there are no results, so the clients get the same shape in every response
 type Metadata struct {
-	CurrentPage int `json:"current_page,omitzero"`
-	PageSize    int `json:"page_size,omitzero"`
+	CurrentPage int `json:"current_page"`
+	PageSize    int `json:"page_size"`
 	// FirstPage    int `json:"first_page,omitzero"`
 	// LastPage     int `json:"last_page,omitzero"`
-	TotalPages   int  `json:"total_pages,omitzero"`
-	TotalRecords int  `json:"total_records,omitzero"`
-	HasNext      bool `json:"has_next,omitzero"`
-	HasPrev      bool `json:"has_prev,omitzero"`
+	TotalPages   int  `json:"total_pages"`
+	TotalRecords int  `json:"total_records"`
+	HasNext      bool `json:"has_next"`
+	HasPrev      bool `json:"has_prev"`
 }
 
+// calculateMetadata returns the pagination metadata of the page. Without records it
+// still reports the requested page and page size, with zero pages and records
 func calculateMetadata(totalRecords int, page int, pageSize int) Metadata {
-	if totalRecords == 0 {
-		return Metadata{}
-	}
-
 	totalPages := (totalRecords + pageSize - 1) / pageSize
 
 	return Metadata{
@@ -82,3 +86,45 @@ func calculateMetadata(totalRecords int, page int, pageSize int) Metadata {
 		HasPrev:      page > 1,
 	}
 }
+
+// paginate runs a query for a page of records and returns them along with the
+// pagination metadata. The first column of the query must be the total number of
+// records, usually with count(*) OVER(), and columns returns the destinations of the
+// rest of the columns for each record
+func paginate[T any](db DB, filters Filters, query string, args []any, columns func(record *T) []any) ([]*T, Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// make sure to always defer close the rows!
+	defer rows.Close()
+
+	totalRecords := 0
+	records := []*T{}
+
+	for rows.Next() {
+		var record T
+
+		dest := append([]any{&totalRecords}, columns(&record)...)
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		records = append(records, &record)
+	}
+
+	// After the rows.next() loop has finished, call rows.Err() to retrieve any error
+	// that was encountered during the iteration
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return records, metadata, nil
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestFiltersSort(t *testing.T) {
+	safeList := []string{"year", "-year"}
+
+	tests := []struct {
+		sort          string
+		wantColumn    string
+		wantDirection string
+	}{
+		{"year", "year", "ASC"},
+		{"-year", "year", "DESC"},
+	}
+
+	for _, tt := range tests {
+		f := Filters{Sort: tt.sort, SortSafeList: safeList}
+
+		if got := f.getSortColumn(); got != tt.wantColumn {
+			t.Errorf("%s: got column %q, want %q", tt.sort, got, tt.wantColumn)
+		}
+		if got := f.getSortDirection(); got != tt.wantDirection {
+			t.Errorf("%s: got direction %q, want %q", tt.sort, got, tt.wantDirection)
+		}
+	}
+}
+
+// queryRecorder is a DB which records the SQL and the arguments of the queries and
+// fails them
+type queryRecorder struct {
+	queries []string
+	args    [][]any
+}
+
+var errQueryRecorded = errors.New("query recorded")
+
+func (db *queryRecorder) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	db.queries = append(db.queries, sql)
+	db.args = append(db.args, args)
+	return pgconn.CommandTag{}, errQueryRecorded
+}
+
+func (db *queryRecorder) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	db.queries = append(db.queries, sql)
+	db.args = append(db.args, args)
+	return nil, errQueryRecorded
+}
+
+func (db *queryRecorder) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	db.queries = append(db.queries, sql)
+	db.args = append(db.args, args)
+	return fakeRow{err: errQueryRecorded}
+}
+
+// orderByRX matches the ORDER BY clause of a query, up to its LIMIT
+var orderByRX = regexp.MustCompile(`ORDER BY\s+(.*?)\s+LIMIT`)
+
+func TestListQueriesOrderBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		filters     Filters
+		query       func(db DB, filters Filters) error
+		wantOrderBy string
+	}{
+		{
+			name:    "movies by year",
+			filters: Filters{Page: 1, PageSize: 20, Sort: "-year", SortSafeList: []string{"year", "-year"}},
+			query: func(db DB, filters Filters) error {
+				_, _, err := NewMovieModel(db).GetAll("", []string{}, []string{}, filters)
+				return err
+			},
+			wantOrderBy: "year DESC, created_at ASC, id ASC",
+		},
+		{
+			name:    "movie history",
+			filters: Filters{Page: 1, PageSize: 20, Sort: "-version", SortSafeList: []string{"version", "-version"}},
+			query: func(db DB, filters Filters) error {
+				_, _, err := NewMovieModel(db).GetHistory("0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81", filters)
+				return err
+			},
+			wantOrderBy: "version DESC, version",
+		},
+		{
+			name:    "audit log",
+			filters: Filters{Page: 1, PageSize: 20, Sort: "created_at", SortSafeList: []string{"created_at", "-created_at"}},
+			query: func(db DB, filters Filters) error {
+				_, _, err := NewAuditModel(db).GetAll("", "", filters)
+				return err
+			},
+			wantOrderBy: "created_at ASC, id DESC",
+		},
+		{
+			name:    "token sessions",
+			filters: Filters{Page: 1, PageSize: 20, Sort: "-expiry", SortSafeList: []string{"expiry", "-expiry"}},
+			query: func(db DB, filters Filters) error {
+				_, _, err := NewTokenModel(db).GetAllFiltered("", filters)
+				return err
+			},
+			wantOrderBy: "tokens.expiry DESC, tokens.hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &queryRecorder{}
+
+			err := tt.query(db, tt.filters)
+			if !errors.Is(err, errQueryRecorded) || len(db.queries) != 1 {
+				t.Fatalf("got error %v and %d queries, want the recorded query", err, len(db.queries))
+			}
+
+			match := orderByRX.FindStringSubmatch(strings.Join(strings.Fields(db.queries[0]), " "))
+			if match == nil {
+				t.Fatalf("no ORDER BY in %q", db.queries[0])
+			}
+			if match[1] != tt.wantOrderBy {
+				t.Errorf("got ORDER BY %q, want %q", match[1], tt.wantOrderBy)
+			}
+		})
+	}
+}
+
+func TestCalculateMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		totalRecords int
+		page         int
+		pageSize     int
+		want         Metadata
+	}{
+		{"no records", 0, 1, 20, Metadata{CurrentPage: 1, PageSize: 20}},
+		{"no records past the first page", 0, 3, 20, Metadata{CurrentPage: 3, PageSize: 20, HasPrev: true}},
+		{"one page", 5, 1, 20, Metadata{CurrentPage: 1, PageSize: 20, TotalPages: 1, TotalRecords: 5}},
+		{"first of several pages", 45, 1, 20, Metadata{CurrentPage: 1, PageSize: 20, TotalPages: 3, TotalRecords: 45, HasNext: true}},
+		{"last of several pages", 45, 3, 20, Metadata{CurrentPage: 3, PageSize: 20, TotalPages: 3, TotalRecords: 45, HasPrev: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calculateMetadata(tt.totalRecords, tt.page, tt.pageSize); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaginateEmptyList(t *testing.T) {
+	filters := Filters{Page: 1, PageSize: 20}
+
+	records, metadata, err := paginate(&rowsDB{}, filters, "SELECT 1", nil, func(movie *Movie) []any {
+		return []any{&movie.ID}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty list is encoded as [] and not as null
+	if records == nil || len(records) != 0 {
+		t.Errorf("got records %v, want an empty list", records)
+	}
+
+	want := Metadata{CurrentPage: 1, PageSize: 20}
+	if metadata != want {
+		t.Errorf("got metadata %+v, want %+v", metadata, want)
+	}
+
+	js, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantJSON := `{"current_page":1,"page_size":20,"total_pages":0,"total_records":0,"has_next":false,"has_prev":false}`
+	if string(js) != wantJSON {
+		t.Errorf("got %s, want %s", js, wantJSON)
+	}
+}
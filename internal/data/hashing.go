@@ -0,0 +1,186 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The algorithms available to hash new passwords
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// PasswordHasher hashes passwords and checks them against their hash. Every hash
+// starts with the identifier of its algorithm, so a hash can always be checked no
+// matter which algorithm is currently used for new passwords
+type PasswordHasher interface {
+	Hash(plaintextPassword string) ([]byte, error)
+	Matches(hash []byte, plaintextPassword string) (bool, error)
+	// Valid reports whether the hash is well formed, without checking any password
+	Valid(hash []byte) bool
+}
+
+var passwordHashers = map[string]PasswordHasher{
+	PasswordHashBcrypt:   bcryptHasher{cost: 12},
+	PasswordHashArgon2id: argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32},
+}
+
+// passwordHasher hashes the new passwords
+var passwordHasher = passwordHashers[PasswordHashBcrypt]
+
+// SetPasswordHashAlgorithm selects the algorithm used to hash new passwords. The hashes
+// made with any of the other algorithms are still checked by Matches()
+func SetPasswordHashAlgorithm(algorithm string) error {
+	hasher, ok := passwordHashers[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+
+	passwordHasher = hasher
+	return nil
+}
+
+// hasherFor returns the hasher of the algorithm that made the hash. bcrypt hashes
+// start with $2a$, $2b$ or $2y$, which is how the hashes made before argon2id was
+// supported still work
+func hasherFor(hash []byte) PasswordHasher {
+	if strings.HasPrefix(string(hash), "$argon2id$") {
+		return passwordHashers[PasswordHashArgon2id]
+	}
+
+	return passwordHashers[PasswordHashBcrypt]
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Valid(hash []byte) bool {
+	_, err := bcrypt.Cost(hash)
+	return err == nil
+}
+
+func (h bcryptHasher) Hash(plaintextPassword string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.cost)
+}
+
+func (h bcryptHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// The bounds of the argon2id parameters read from a hash. A stored hash with huge
+// parameters would make every login with it use that much memory and time, and zero
+// parameters make argon2.IDKey() panic
+const (
+	argon2idMaxMemory = 1024 * 1024 // KiB, 1 GiB
+	argon2idMaxTime   = 16
+	argon2idMinSalt   = 8
+	argon2idMaxSalt   = 64
+	argon2idMinKeyLen = 4
+	argon2idMaxKeyLen = 64
+)
+
+// argon2idHasher encodes the hashes in the PHC string format used by the reference
+// implementation, e.g. $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>, so the parameters
+// can be changed without breaking the existing hashes
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func (h argon2idHasher) Hash(plaintextPassword string) ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, h.time, h.memory, h.threads, h.keyLen)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+func (h argon2idHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	params, salt, key, err := h.decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.time, params.memory, params.threads, params.keyLen)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h argon2idHasher) Valid(hash []byte) bool {
+	_, _, _, err := h.decode(hash)
+	return err == nil
+}
+
+// decode returns the parameters, the salt and the key of an encoded hash
+func (h argon2idHasher) decode(hash []byte) (argon2idHasher, []byte, []byte, error) {
+	var params argon2idHasher
+
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	// argon2 needs at least 8 KiB of memory per thread
+	if params.time < 1 || params.time > argon2idMaxTime || params.threads < 1 ||
+		params.memory < 8*uint32(params.threads) || params.memory > argon2idMaxMemory {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < argon2idMinSalt || len(salt) > argon2idMaxSalt {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < argon2idMinKeyLen || len(key) > argon2idMaxKeyLen {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	params.keyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestArgon2idHasherValid(t *testing.T) {
+	hasher := passwordHashers[PasswordHashArgon2id]
+
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + key, true},
+		{"zero time and threads", "$argon2id$v=19$m=65536,t=0,p=0$" + salt + "$" + key, false},
+		{"zero time", "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, false},
+		{"zero threads", "$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + key, false},
+		{"too little memory", "$argon2id$v=19$m=16,t=1,p=4$" + salt + "$" + key, false},
+		{"too much memory", "$argon2id$v=19$m=4194304,t=1,p=4$" + salt + "$" + key, false},
+		{"too many iterations", "$argon2id$v=19$m=65536,t=1000,p=4$" + salt + "$" + key, false},
+		{"empty salt", "$argon2id$v=19$m=65536,t=1,p=4$$" + key, false},
+		{"salt too long", "$argon2id$v=19$m=65536,t=1,p=4$" + strings.Repeat(salt, 6) + "$" + key, false},
+		{"empty key", "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$", false},
+		{"key too long", "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + strings.Repeat(key, 3), false},
+		{"other version", "$argon2id$v=16$m=65536,t=1,p=4$" + salt + "$" + key, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasher.Valid([]byte(tt.hash)); got != tt.want {
+				t.Errorf("got Valid() %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgon2idHasherMatches(t *testing.T) {
+	hasher := passwordHashers[PasswordHashArgon2id]
+
+	hash, err := hasher.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasher.Valid(hash) {
+		t.Fatalf("the hash %q isn't valid", hash)
+	}
+
+	for password, want := range map[string]bool{"pa55word1234": true, "wrong password": false} {
+		got, err := hasher.Matches(hash, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got Matches(%q) %t, want %t", password, got, want)
+		}
+	}
+
+	// a hash with zero parameters must fail instead of panicking in argon2.IDKey()
+	_, err = hasher.Matches([]byte("$argon2id$v=19$m=65536,t=0,p=0$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5"), "pa55word1234")
+	if err == nil {
+		t.Error("got no error matching a hash with zero parameters")
+	}
+}
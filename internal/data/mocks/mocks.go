@@ -0,0 +1,407 @@
+// Package mocks has fakes of the data repositories, so the handlers can be tested
+// without a database. Every method calls the function field with the same name and
+// the Func suffix, and panics when it's not set, so a test only sets the functions of
+// the calls it expects:
+//
+//	models := data.Models{
+//		Movies: &mocks.MovieModel{
+//			GetFunc: func(id string) (*data.Movie, error) {
+//				return nil, data.ErrRecordNotFound
+//			},
+//		},
+//	}
+package mocks
+
+import (
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/data"
+)
+
+func unexpectedCall(method string) {
+	panic("mocks: unexpected call to " + method)
+}
+
+// MovieModel is a fake data.MovieRepository
+type MovieModel struct {
+	InsertFunc     func(movie *data.Movie) error
+	UpsertFunc     func(movie *data.Movie) (bool, error)
+	GetFunc        func(id string) (*data.Movie, error)
+	UpdateFunc     func(movie *data.Movie) error
+	DeleteFunc     func(id string) error
+	GetRandomFunc  func(genres []string, statuses []string) (*data.Movie, error)
+	SuggestFunc    func(prefix string, limit int) ([]*data.Movie, error)
+	CountFunc      func(title string, genres []string, statuses []string) (int, error)
+	GetAllFunc     func(title string, genres []string, statuses []string, filters data.Filters) ([]*data.Movie, data.Metadata, error)
+	GetHistoryFunc func(id string, filters data.Filters) ([]*data.MovieVersion, data.Metadata, error)
+}
+
+var _ data.MovieRepository = (*MovieModel)(nil)
+
+func (m *MovieModel) Insert(movie *data.Movie) error {
+	if m.InsertFunc == nil {
+		unexpectedCall("MovieModel.Insert")
+	}
+	return m.InsertFunc(movie)
+}
+
+func (m *MovieModel) Upsert(movie *data.Movie) (bool, error) {
+	if m.UpsertFunc == nil {
+		unexpectedCall("MovieModel.Upsert")
+	}
+	return m.UpsertFunc(movie)
+}
+
+func (m *MovieModel) Get(id string) (*data.Movie, error) {
+	if m.GetFunc == nil {
+		unexpectedCall("MovieModel.Get")
+	}
+	return m.GetFunc(id)
+}
+
+func (m *MovieModel) Update(movie *data.Movie) error {
+	if m.UpdateFunc == nil {
+		unexpectedCall("MovieModel.Update")
+	}
+	return m.UpdateFunc(movie)
+}
+
+func (m *MovieModel) Delete(id string) error {
+	if m.DeleteFunc == nil {
+		unexpectedCall("MovieModel.Delete")
+	}
+	return m.DeleteFunc(id)
+}
+
+func (m *MovieModel) GetRandom(genres []string, statuses []string) (*data.Movie, error) {
+	if m.GetRandomFunc == nil {
+		unexpectedCall("MovieModel.GetRandom")
+	}
+	return m.GetRandomFunc(genres, statuses)
+}
+
+func (m *MovieModel) Suggest(prefix string, limit int) ([]*data.Movie, error) {
+	if m.SuggestFunc == nil {
+		unexpectedCall("MovieModel.Suggest")
+	}
+	return m.SuggestFunc(prefix, limit)
+}
+
+func (m *MovieModel) Count(title string, genres []string, statuses []string) (int, error) {
+	if m.CountFunc == nil {
+		unexpectedCall("MovieModel.Count")
+	}
+	return m.CountFunc(title, genres, statuses)
+}
+
+func (m *MovieModel) GetAll(title string, genres []string, statuses []string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	if m.GetAllFunc == nil {
+		unexpectedCall("MovieModel.GetAll")
+	}
+	return m.GetAllFunc(title, genres, statuses, filters)
+}
+
+func (m *MovieModel) GetHistory(id string, filters data.Filters) ([]*data.MovieVersion, data.Metadata, error) {
+	if m.GetHistoryFunc == nil {
+		unexpectedCall("MovieModel.GetHistory")
+	}
+	return m.GetHistoryFunc(id, filters)
+}
+
+// UserModel is a fake data.UserRepository
+type UserModel struct {
+	InsertFunc                     func(user *data.User) error
+	InsertIfNewFunc                func(user *data.User) error
+	GetByEmailFunc                 func(email string) (*data.User, error)
+	UpdateFunc                     func(user *data.User) error
+	GetForTokenFunc                func(tokenScope string, tokenPlainText string) (*data.User, error)
+	GetForTokenWithPermissionsFunc func(tokenScope string, tokenPlainText string) (*data.User, data.Permissions, *data.Token, error)
+	SetRateLimitFunc               func(userID string, limit *data.RateLimit) error
+	GetMissingIDsFunc              func(ids []string) ([]string, error)
+}
+
+var _ data.UserRepository = (*UserModel)(nil)
+
+func (m *UserModel) Insert(user *data.User) error {
+	if m.InsertFunc == nil {
+		unexpectedCall("UserModel.Insert")
+	}
+	return m.InsertFunc(user)
+}
+
+func (m *UserModel) InsertIfNew(user *data.User) error {
+	if m.InsertIfNewFunc == nil {
+		unexpectedCall("UserModel.InsertIfNew")
+	}
+	return m.InsertIfNewFunc(user)
+}
+
+func (m *UserModel) GetByEmail(email string) (*data.User, error) {
+	if m.GetByEmailFunc == nil {
+		unexpectedCall("UserModel.GetByEmail")
+	}
+	return m.GetByEmailFunc(email)
+}
+
+func (m *UserModel) Update(user *data.User) error {
+	if m.UpdateFunc == nil {
+		unexpectedCall("UserModel.Update")
+	}
+	return m.UpdateFunc(user)
+}
+
+func (m *UserModel) GetForToken(tokenScope string, tokenPlainText string) (*data.User, error) {
+	if m.GetForTokenFunc == nil {
+		unexpectedCall("UserModel.GetForToken")
+	}
+	return m.GetForTokenFunc(tokenScope, tokenPlainText)
+}
+
+func (m *UserModel) GetForTokenWithPermissions(tokenScope string, tokenPlainText string) (*data.User, data.Permissions, *data.Token, error) {
+	if m.GetForTokenWithPermissionsFunc == nil {
+		unexpectedCall("UserModel.GetForTokenWithPermissions")
+	}
+	return m.GetForTokenWithPermissionsFunc(tokenScope, tokenPlainText)
+}
+
+func (m *UserModel) SetRateLimit(userID string, limit *data.RateLimit) error {
+	if m.SetRateLimitFunc == nil {
+		unexpectedCall("UserModel.SetRateLimit")
+	}
+	return m.SetRateLimitFunc(userID, limit)
+}
+
+func (m *UserModel) GetMissingIDs(ids []string) ([]string, error) {
+	if m.GetMissingIDsFunc == nil {
+		unexpectedCall("UserModel.GetMissingIDs")
+	}
+	return m.GetMissingIDsFunc(ids)
+}
+
+// TokenModel is a fake data.TokenRepository
+type TokenModel struct {
+	NewFunc                 func(userID string, ttl time.Duration, scope string) (*data.Token, error)
+	NewEmailChangeFunc      func(userID string, ttl time.Duration, pendingEmail string) (*data.Token, error)
+	InsertFunc              func(token *data.Token) error
+	GetPendingEmailFunc     func(tokenPlainText string) (string, error)
+	DeleteAllForUserFunc    func(scope string, userID string) error
+	DeleteOldestForUserFunc func(scope string, userID string, keep int) error
+	ExtendExpiryFunc        func(hash []byte, expiry time.Time) error
+	GetAllFilteredFunc      func(scope string, filters data.Filters) ([]*data.TokenSession, data.Metadata, error)
+	DeleteAllFilteredFunc   func(userID string, scope string) (int64, error)
+}
+
+var _ data.TokenRepository = (*TokenModel)(nil)
+
+func (m *TokenModel) New(userID string, ttl time.Duration, scope string) (*data.Token, error) {
+	if m.NewFunc == nil {
+		unexpectedCall("TokenModel.New")
+	}
+	return m.NewFunc(userID, ttl, scope)
+}
+
+func (m *TokenModel) NewEmailChange(userID string, ttl time.Duration, pendingEmail string) (*data.Token, error) {
+	if m.NewEmailChangeFunc == nil {
+		unexpectedCall("TokenModel.NewEmailChange")
+	}
+	return m.NewEmailChangeFunc(userID, ttl, pendingEmail)
+}
+
+func (m *TokenModel) Insert(token *data.Token) error {
+	if m.InsertFunc == nil {
+		unexpectedCall("TokenModel.Insert")
+	}
+	return m.InsertFunc(token)
+}
+
+func (m *TokenModel) GetPendingEmail(tokenPlainText string) (string, error) {
+	if m.GetPendingEmailFunc == nil {
+		unexpectedCall("TokenModel.GetPendingEmail")
+	}
+	return m.GetPendingEmailFunc(tokenPlainText)
+}
+
+func (m *TokenModel) DeleteAllForUser(scope string, userID string) error {
+	if m.DeleteAllForUserFunc == nil {
+		unexpectedCall("TokenModel.DeleteAllForUser")
+	}
+	return m.DeleteAllForUserFunc(scope, userID)
+}
+
+func (m *TokenModel) DeleteOldestForUser(scope string, userID string, keep int) error {
+	if m.DeleteOldestForUserFunc == nil {
+		unexpectedCall("TokenModel.DeleteOldestForUser")
+	}
+	return m.DeleteOldestForUserFunc(scope, userID, keep)
+}
+
+func (m *TokenModel) ExtendExpiry(hash []byte, expiry time.Time) error {
+	if m.ExtendExpiryFunc == nil {
+		unexpectedCall("TokenModel.ExtendExpiry")
+	}
+	return m.ExtendExpiryFunc(hash, expiry)
+}
+
+func (m *TokenModel) GetAllFiltered(scope string, filters data.Filters) ([]*data.TokenSession, data.Metadata, error) {
+	if m.GetAllFilteredFunc == nil {
+		unexpectedCall("TokenModel.GetAllFiltered")
+	}
+	return m.GetAllFilteredFunc(scope, filters)
+}
+
+func (m *TokenModel) DeleteAllFiltered(userID string, scope string) (int64, error) {
+	if m.DeleteAllFilteredFunc == nil {
+		unexpectedCall("TokenModel.DeleteAllFiltered")
+	}
+	return m.DeleteAllFilteredFunc(userID, scope)
+}
+
+// PermissionModel is a fake data.PermissionRepository
+type PermissionModel struct {
+	InsertFunc         func(codes ...string) (int64, error)
+	GetAllFunc         func() (data.Permissions, error)
+	GetAllForUserFunc  func(userID string) (data.Permissions, error)
+	AddForUserFunc     func(userID string, codes ...string) error
+	AddForUsersFunc    func(userIDs []string, codes []string) (int64, error)
+	RemoveForUsersFunc func(userIDs []string, codes []string) (int64, error)
+}
+
+var _ data.PermissionRepository = (*PermissionModel)(nil)
+
+func (m *PermissionModel) Insert(codes ...string) (int64, error) {
+	if m.InsertFunc == nil {
+		unexpectedCall("PermissionModel.Insert")
+	}
+	return m.InsertFunc(codes...)
+}
+
+func (m *PermissionModel) GetAll() (data.Permissions, error) {
+	if m.GetAllFunc == nil {
+		unexpectedCall("PermissionModel.GetAll")
+	}
+	return m.GetAllFunc()
+}
+
+func (m *PermissionModel) GetAllForUser(userID string) (data.Permissions, error) {
+	if m.GetAllForUserFunc == nil {
+		unexpectedCall("PermissionModel.GetAllForUser")
+	}
+	return m.GetAllForUserFunc(userID)
+}
+
+func (m *PermissionModel) AddForUser(userID string, codes ...string) error {
+	if m.AddForUserFunc == nil {
+		unexpectedCall("PermissionModel.AddForUser")
+	}
+	return m.AddForUserFunc(userID, codes...)
+}
+
+func (m *PermissionModel) AddForUsers(userIDs []string, codes []string) (int64, error) {
+	if m.AddForUsersFunc == nil {
+		unexpectedCall("PermissionModel.AddForUsers")
+	}
+	return m.AddForUsersFunc(userIDs, codes)
+}
+
+func (m *PermissionModel) RemoveForUsers(userIDs []string, codes []string) (int64, error) {
+	if m.RemoveForUsersFunc == nil {
+		unexpectedCall("PermissionModel.RemoveForUsers")
+	}
+	return m.RemoveForUsersFunc(userIDs, codes)
+}
+
+// AuditModel is a fake data.AuditRepository
+type AuditModel struct {
+	RecordFunc func(actorID string, action string, target string, changes map[string]any) error
+	GetAllFunc func(actorID string, action string, filters data.Filters) ([]*data.AuditEntry, data.Metadata, error)
+}
+
+var _ data.AuditRepository = (*AuditModel)(nil)
+
+func (m *AuditModel) Record(actorID string, action string, target string, changes map[string]any) error {
+	if m.RecordFunc == nil {
+		unexpectedCall("AuditModel.Record")
+	}
+	return m.RecordFunc(actorID, action, target, changes)
+}
+
+func (m *AuditModel) GetAll(actorID string, action string, filters data.Filters) ([]*data.AuditEntry, data.Metadata, error) {
+	if m.GetAllFunc == nil {
+		unexpectedCall("AuditModel.GetAll")
+	}
+	return m.GetAllFunc(actorID, action, filters)
+}
+
+// APIKeyModel is a fake data.APIKeyRepository
+type APIKeyModel struct {
+	InsertFunc         func(key *data.APIKey) error
+	GetAllFunc         func() ([]*data.APIKey, error)
+	RevokeFunc         func(id string) error
+	GetOwnerForKeyFunc func(plaintext string) (*data.User, data.Permissions, error)
+}
+
+var _ data.APIKeyRepository = (*APIKeyModel)(nil)
+
+func (m *APIKeyModel) Insert(key *data.APIKey) error {
+	if m.InsertFunc == nil {
+		unexpectedCall("APIKeyModel.Insert")
+	}
+	return m.InsertFunc(key)
+}
+
+func (m *APIKeyModel) GetAll() ([]*data.APIKey, error) {
+	if m.GetAllFunc == nil {
+		unexpectedCall("APIKeyModel.GetAll")
+	}
+	return m.GetAllFunc()
+}
+
+func (m *APIKeyModel) Revoke(id string) error {
+	if m.RevokeFunc == nil {
+		unexpectedCall("APIKeyModel.Revoke")
+	}
+	return m.RevokeFunc(id)
+}
+
+func (m *APIKeyModel) GetOwnerForKey(plaintext string) (*data.User, data.Permissions, error) {
+	if m.GetOwnerForKeyFunc == nil {
+		unexpectedCall("APIKeyModel.GetOwnerForKey")
+	}
+	return m.GetOwnerForKeyFunc(plaintext)
+}
+
+// FailedTaskModel is a fake data.FailedTaskRepository
+type FailedTaskModel struct {
+	InsertFunc func(task *data.FailedTask) error
+}
+
+var _ data.FailedTaskRepository = (*FailedTaskModel)(nil)
+
+func (m *FailedTaskModel) Insert(task *data.FailedTask) error {
+	if m.InsertFunc == nil {
+		unexpectedCall("FailedTaskModel.Insert")
+	}
+	return m.InsertFunc(task)
+}
+
+// FeatureFlagModel is a fake data.FeatureFlagRepository
+type FeatureFlagModel struct {
+	GetAllFunc func() (map[string]*data.FeatureFlag, error)
+	SetFunc    func(flag *data.FeatureFlag) error
+}
+
+var _ data.FeatureFlagRepository = (*FeatureFlagModel)(nil)
+
+func (m *FeatureFlagModel) GetAll() (map[string]*data.FeatureFlag, error) {
+	if m.GetAllFunc == nil {
+		unexpectedCall("FeatureFlagModel.GetAll")
+	}
+	return m.GetAllFunc()
+}
+
+func (m *FeatureFlagModel) Set(flag *data.FeatureFlag) error {
+	if m.SetFunc == nil {
+		unexpectedCall("FeatureFlagModel.Set")
+	}
+	return m.SetFunc(flag)
+}
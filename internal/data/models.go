@@ -2,8 +2,6 @@ package data
 
 import (
 	"errors"
-
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
@@ -12,17 +10,27 @@ var (
 )
 
 type Models struct {
-	Movies      *MovieModel
-	Users       *UserModel
-	Tokens      *TokenModel
-	Permissions *PermissionModel
+	Movies      MovieRepository
+	Users       UserRepository
+	Tokens      TokenRepository
+	Permissions PermissionRepository
+	Audit       AuditRepository
+	APIKeys     APIKeyRepository
+	FailedTasks FailedTaskRepository
+	Features    FeatureFlagRepository
 }
 
-func NewModels(db *pgxpool.Pool) Models {
+// NewModels returns the models backed by the database. The movie model has settings
+// of its own, so it can be replaced with a configured one
+func NewModels(db DB) Models {
 	return Models{
 		Movies:      NewMovieModel(db),
 		Users:       NewUserModel(db),
 		Tokens:      NewTokenModel(db),
 		Permissions: NewPermissionModel(db),
+		Audit:       NewAuditModel(db),
+		APIKeys:     NewAPIKeyModel(db),
+		FailedTasks: NewFailedTaskModel(db),
+		Features:    NewFeatureFlagModel(db),
 	}
 }
@@ -0,0 +1,67 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MovieVersion is a previous version of a movie, as it was before being changed at
+// ReplacedAt. The versions are recorded by a trigger of the movies table
+type MovieVersion struct {
+	Version    int32     `json:"version"`
+	ReplacedAt time.Time `json:"replaced_at"`
+	Title      string    `json:"title"`
+	Year       int32     `json:"year"`
+	Runtime    Runtime   `json:"runtime,string"`
+	Genres     []string  `json:"genres"`
+}
+
+// GetHistory returns the previous versions of the movie with the given ID
+func (m MovieModel) GetHistory(id string, filters Filters) ([]*MovieVersion, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), version, replaced_at, title, year, runtime, genres
+		FROM movie_versions
+		WHERE movie_id = $1
+		ORDER BY %s %s, version
+		LIMIT $2 OFFSET $3
+	`, filters.getSortColumn(), filters.getSortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, id, filters.getLimit(), filters.getOffSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	versions := []*MovieVersion{}
+
+	for rows.Next() {
+		var version MovieVersion
+		err := rows.Scan(
+			&totalRecords,
+			&version.Version,
+			&version.ReplacedAt,
+			&version.Title,
+			&version.Year,
+			&version.Runtime,
+			&version.Genres,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		versions = append(versions, &version)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return versions, metadata, nil
+}
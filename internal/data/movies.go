@@ -2,28 +2,76 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
+var (
+	ErrDuplicateMovie = errors.New("duplicate movie")
+	// ErrTooManyGenres is returned when a movie that hasn't been validated reaches the
+	// model with more genres than allowed
+	ErrTooManyGenres = fmt.Errorf("a movie must not have more than %d genres", MaxGenres)
+)
+
+// MaxGenres is the maximum number of genres of a movie. The genres_length_check
+// constraint of the movies table enforces the same limit
+const MaxGenres = 5
+
+// The statuses of a movie. Only the published movies are visible to the users who
+// can't change movies, the drafts are staged until they are published
+const (
+	MovieStatusDraft     = "draft"
+	MovieStatusPublished = "published"
+	MovieStatusArchived  = "archived"
+)
+
+// MovieStatuses are the statuses a movie can have, the movies_status_check constraint
+// of the movies table allows the same ones
+var MovieStatuses = []string{MovieStatusDraft, MovieStatusPublished, MovieStatusArchived}
+
 type Movie struct {
-	ID        string    `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitzero"`
-	Runtime   Runtime   `json:"runtime,omitzero,string"`
-	Genres    []string  `json:"genres,omitzero"`
-	Version   int32     `json:"version"`
+	ID         string    `json:"id,omitzero"`
+	ExternalID string    `json:"external_id,omitzero"`
+	CreatedAt  time.Time `json:"created_at,omitzero"`
+	Title      string    `json:"title"`
+	Year       int32     `json:"year,omitzero"`
+	Runtime    Runtime   `json:"runtime,omitzero,string"`
+	Genres     []string  `json:"genres,omitzero"`
+	Status     string    `json:"status,omitzero"`
+	Version    int32     `json:"version,omitzero"`
+}
+
+// allowedGenres is the controlled vocabulary of the genres, any genre is allowed when
+// it's empty
+var allowedGenres []string
+
+// SetAllowedGenres restricts the genres accepted by ValidateMovie to the given ones,
+// an empty list allows any genre
+func SetAllowedGenres(genres []string) {
+	allowedGenres = slices.Clone(genres)
+}
+
+// AllowedGenres returns the genres accepted by ValidateMovie, empty when any genre is
+// allowed
+func AllowedGenres() []string {
+	return slices.Clone(allowedGenres)
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 50n bytes long")
+	// the handlers trim the title, but a title made only of whitespace must be
+	// rejected anyway. The length is counted in characters, not in bytes, so titles
+	// in any language get the same limit
+	v.Check(strings.TrimSpace(movie.Title) != "", "title", "must be provided")
+	v.Check(utf8.RuneCountInString(movie.Title) <= 500, "title", "must not be more than 500 characters long")
 
 	v.Check(movie.Year != 0, "year", "year must be provided")
 	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
@@ -32,29 +80,101 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be positive")
 
+	// a null or missing genres field decodes to a nil slice, which is reported as
+	// not provided, while an empty array is reported as having too few genres
 	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(movie.Genres == nil || len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
+	v.Check(len(movie.Genres) <= MaxGenres, "genres", v.Sprintf("must not contain more than %d genres", MaxGenres))
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicated values")
+
+	if len(allowedGenres) > 0 {
+		unknown := slices.DeleteFunc(slices.Clone(movie.Genres), func(genre string) bool {
+			return slices.Contains(allowedGenres, genre)
+		})
+		v.Check(len(unknown) == 0, "genres", v.Sprintf("these genres are not allowed: %s", strings.Join(unknown, ", ")))
+	}
+
+	ValidateMovieStatus(v, movie.Status)
+}
+
+func ValidateMovieStatus(v *validator.Validator, status string) {
+	v.Check(validator.PermittedValues(status, MovieStatuses...), "status", "must be one of draft, published or archived")
+}
+
+func ValidateExternalID(v *validator.Validator, externalID string) {
+	v.Check(externalID != "", "external_id", "must be provided")
+	v.Check(len(externalID) <= 255, "external_id", "must not be more than 255 bytes long")
 }
 
 type MovieModel struct {
-	DB *pgxpool.Pool
+	DB DB
+	// UniqueTitleYear makes the movies inserted from now on take part in the
+	// "movies_title_year_key" unique index, so inserting or updating a movie with the
+	// same title and year than another one fails with ErrDuplicateMovie. Movies
+	// inserted while it's false are allowed to be duplicates
+	UniqueTitleYear bool
+	cache           *movieCache
 }
 
-func NewMovieModel(db *pgxpool.Pool) *MovieModel {
+func NewMovieModel(db DB) *MovieModel {
 	return &MovieModel{
 		DB: db,
 	}
 }
 
+// WithDB returns a copy of the model which runs its queries on db, sharing the
+// settings and the cache of m
+func (m *MovieModel) WithDB(db DB) *MovieModel {
+	movies := *m
+	movies.DB = db
+
+	return &movies
+}
+
+// EnableCache puts an in-memory LRU cache of the given size in front of Get(). The
+// cached movies are refreshed on Update() and removed on Delete() and Upsert()
+func (m *MovieModel) EnableCache(size int, ttl time.Duration) {
+	m.cache = newMovieCache(size, ttl)
+}
+
+// CacheStats returns the number of cache hits and misses, and the number of cached
+// movies. It returns zeros when the cache isn't enabled
+func (m *MovieModel) CacheStats() (hits int64, misses int64, size int) {
+	if m.cache == nil {
+		return 0, 0, 0
+	}
+
+	return m.cache.hits.Load(), m.cache.misses.Load(), m.cache.len()
+}
+
+// checkGenres guards the queries writing movies against the ones which skipped
+// ValidateMovie(), so a bug can't send a huge genres array to the database
+func checkGenres(movie *Movie) error {
+	if len(movie.Genres) > MaxGenres {
+		return ErrTooManyGenres
+	}
+
+	return nil
+}
+
 func (m MovieModel) Insert(movie *Movie) error {
+	if err := checkGenres(movie); err != nil {
+		return err
+	}
+
 	query := `
-	INSERT INTO movies (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO movies (title, year, runtime, genres, unique_title_year, created_at, status)
+	VALUES ($1, $2, $3, $4, $5, COALESCE($6, now()), $7)
 	RETURNING id, created_at, version
 	`
 
+	// the creation date is only set by the client when importing movies, otherwise
+	// we pass NULL so the database sets it
+	var createdAt *time.Time
+	if !movie.CreatedAt.IsZero() {
+		createdAt = &movie.CreatedAt
+	}
+
 	cxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -65,8 +185,66 @@ func (m MovieModel) Insert(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		movie.Genres,
+		m.UniqueTitleYear,
+		createdAt,
+		movie.Status,
 	).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 
+	return duplicateMovieError(err)
+}
+
+// Upsert inserts the movie or, when a movie with the same external ID already exists,
+// updates it. It returns true when the movie was created.
+func (m MovieModel) Upsert(movie *Movie) (bool, error) {
+	if err := checkGenres(movie); err != nil {
+		return false, err
+	}
+
+	// xmax is 0 for freshly inserted rows, this is how we know whether the
+	// statement inserted or updated the row
+	query := `
+	INSERT INTO movies (external_id, title, year, runtime, genres, unique_title_year, status)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (external_id) DO UPDATE
+	SET title = EXCLUDED.title, year = EXCLUDED.year, runtime = EXCLUDED.runtime,
+		genres = EXCLUDED.genres, status = EXCLUDED.status, version = movies.version + 1
+	RETURNING id, created_at, version, (xmax = 0) AS created
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var created bool
+
+	err := m.DB.QueryRow(
+		ctx,
+		query,
+		movie.ExternalID,
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		movie.Genres,
+		m.UniqueTitleYear,
+		movie.Status,
+	).Scan(&movie.ID, &movie.CreatedAt, &movie.Version, &created)
+
+	if err == nil && m.cache != nil {
+		m.cache.remove(movie.ID)
+	}
+
+	return created, duplicateMovieError(err)
+}
+
+// duplicateMovieError returns ErrDuplicateMovie when err is a violation of the
+// "movies_title_year_key" unique index, and err otherwise
+func duplicateMovieError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if pgErr.Code == "23505" && pgErr.ConstraintName == "movies_title_year_key" {
+			return ErrDuplicateMovie
+		}
+	}
+
 	return err
 }
 
@@ -75,8 +253,14 @@ func (m MovieModel) Get(id string) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
+	if m.cache != nil {
+		if movie, ok := m.cache.get(id); ok {
+			return movie, nil
+		}
+	}
+
 	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
+	SELECT id, COALESCE(external_id, ''), created_at, title, year, runtime, genres, status, version
 	FROM movies
 	WHERE id = $1
 	`
@@ -91,11 +275,13 @@ func (m MovieModel) Get(id string) (*Movie, error) {
 	var movie Movie
 	err := m.DB.QueryRow(ctx, query, id).Scan(
 		&movie.ID,
+		&movie.ExternalID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		&movie.Genres,
+		&movie.Status,
 		&movie.Version,
 	)
 
@@ -108,14 +294,22 @@ func (m MovieModel) Get(id string) (*Movie, error) {
 		}
 	}
 
+	if m.cache != nil {
+		m.cache.set(&movie)
+	}
+
 	return &movie, nil
 }
 
 func (m MovieModel) Update(movie *Movie) error {
+	if err := checkGenres(movie); err != nil {
+		return err
+	}
+
 	query := `
 	UPDATE movies
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-	WHERE id = $5 and VERSION = $6
+	SET title = $1, year = $2, runtime = $3, genres = $4, status = $5, version = version + 1
+	WHERE id = $6 and VERSION = $7
 	RETURNING version
 	`
 
@@ -124,6 +318,7 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		movie.Genres,
+		movie.Status,
 		movie.ID,
 		movie.Version,
 	}
@@ -138,12 +333,21 @@ func (m MovieModel) Update(movie *Movie) error {
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
+			// the cached movie, if any, is outdated, so the client gets the latest
+			// version when it reads the movie again
+			if m.cache != nil {
+				m.cache.remove(movie.ID)
+			}
 			return ErrEditConflict
 		default:
-			return err
+			return duplicateMovieError(err)
 		}
 	}
 
+	if m.cache != nil {
+		m.cache.set(movie)
+	}
+
 	return nil
 }
 
@@ -165,6 +369,10 @@ func (m MovieModel) Delete(id string) error {
 		return err
 	}
 
+	if m.cache != nil {
+		m.cache.remove(id)
+	}
+
 	rowsAffected := result.RowsAffected()
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
@@ -173,67 +381,156 @@ func (m MovieModel) Delete(id string) error {
 	return nil
 }
 
-func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(
-		`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
+// moviesFilterCondition is the WHERE condition shared by GetAll() and Count(), where
+// $1 is the title to search, $2 the genres the movies must contain and $3 the
+// statuses the movies can have (any status when empty)
+const moviesFilterCondition = `
+		(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, created_at ASC
-		LIMIT $3 OFFSET $4
-	`,
-		filters.getSortColumn(),
-		filters.getSortDirection(),
-	)
+		AND (status = ANY($3) OR $3 = '{}')
+`
+
+// GetRandom returns a random movie containing all the given genres (any movie when
+// genres is empty) and having one of the given statuses (any status when empty). Instead of sorting the whole table with ORDER BY random(), it picks
+// a random UUID and returns the first movie from there using the primary key index,
+// wrapping around to the start of the index when there's none after it. It returns
+// ErrRecordNotFound when no movie matches.
+func (m *MovieModel) GetRandom(genres []string, statuses []string) (*Movie, error) {
+	query := `
+	(SELECT id, COALESCE(external_id, ''), created_at, title, year, runtime, genres, status, version
+	FROM movies
+	WHERE id >= $1 AND (genres @> $2 OR $2 = '{}') AND (status = ANY($3) OR $3 = '{}')
+	ORDER BY id
+	LIMIT 1)
+	UNION ALL
+	(SELECT id, COALESCE(external_id, ''), created_at, title, year, runtime, genres, status, version
+	FROM movies
+	WHERE id < $1 AND (genres @> $2 OR $2 = '{}') AND (status = ANY($3) OR $3 = '{}')
+	ORDER BY id
+	LIMIT 1)
+	LIMIT 1
+	`
+
+	pivot := make([]byte, 16)
+	rand.Read(pivot)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.Query(
-		ctx,
-		query,
-		title,
-		genres,
-		filters.getLimit(),
-		filters.getOffSet(),
+	var movie Movie
+	err := m.DB.QueryRow(ctx, query, fmt.Sprintf("%x-%x-%x-%x-%x", pivot[0:4], pivot[4:6], pivot[6:8], pivot[8:10], pivot[10:]), genres, statuses).Scan(
+		&movie.ID,
+		&movie.ExternalID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		&movie.Genres,
+		&movie.Status,
+		&movie.Version,
 	)
+
 	if err != nil {
-		return nil, Metadata{}, err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
 	}
 
-	// make sure to always defer close the rows!
+	return &movie, nil
+}
+
+// likeEscaper escapes the wildcards of the LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Suggest returns the id and the title of up to limit published movies whose title
+// starts with prefix, ignoring the case, the most similar to prefix first. The
+// movies_title_trgm_idx trigram index makes the prefix match fast even for partial
+// words, which the full-text search of GetAll() doesn't match
+func (m *MovieModel) Suggest(prefix string, limit int) ([]*Movie, error) {
+	query := `
+	SELECT id, title
+	FROM movies
+	WHERE title ILIKE $1 AND status = 'published'
+	ORDER BY similarity(title, $2) DESC, title, id
+	LIMIT $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, likeEscaper.Replace(prefix)+"%", prefix, limit)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	totalRecords := 0
 	movies := []*Movie{}
 
 	for rows.Next() {
 		var movie Movie
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			&movie.Genres,
-			&movie.Version,
-		)
+		err := rows.Scan(&movie.ID, &movie.Title)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, err
 		}
 
 		movies = append(movies, &movie)
 	}
 
-	// After the rows.next() loop has finished, call rows.Err() to retrieve any error
-	// that was encountered during the iteration
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// Count returns the number of movies matching the same filters as GetAll(), without
+// the overhead of the window function and of reading the rows
+func (m *MovieModel) Count(title string, genres []string, statuses []string) (int, error) {
+	query := `SELECT count(*) FROM movies WHERE ` + moviesFilterCondition
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRow(ctx, query, title, genres, statuses).Scan(&count)
+	if err != nil {
+		return 0, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return count, nil
+}
+
+func (m *MovieModel) GetAll(title string, genres []string, statuses []string, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(
+		`
+		SELECT count(*) OVER(), id, COALESCE(external_id, ''), created_at, title, year, runtime, genres, status, version
+		FROM movies
+		WHERE %s
+		ORDER BY %s %s, created_at ASC, id ASC
+		LIMIT $4 OFFSET $5
+	`,
+		moviesFilterCondition,
+		filters.getSortColumn(),
+		filters.getSortDirection(),
+	)
 
-	return movies, metadata, nil
+	args := []any{title, genres, statuses, filters.getLimit(), filters.getOffSet()}
+
+	return paginate(m.DB, filters, query, args, func(movie *Movie) []any {
+		return []any{
+			&movie.ID,
+			&movie.ExternalID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.Status,
+			&movie.Version,
+		}
+	})
 }
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/validator"
+)
+
+// validMovie returns a movie which passes ValidateMovie
+func validMovie() *Movie {
+	return &Movie{
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+		Status:  MovieStatusPublished,
+	}
+}
+
+func TestValidateMovieGenres(t *testing.T) {
+	tests := []struct {
+		name      string
+		genres    []string
+		wantError string
+	}{
+		{"null or omitted", nil, "must be provided"},
+		{"empty array", []string{}, "must contain at least 1 genre"},
+		{"one genre", []string{"drama"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := validMovie()
+			movie.Genres = tt.genres
+
+			v := validator.New()
+			ValidateMovie(v, movie)
+
+			if got := v.Errors["genres"]; got != tt.wantError {
+				t.Errorf("got genres error %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestValidateMovieTitle(t *testing.T) {
+	tests := []struct {
+		name      string
+		title     string
+		wantError string
+	}{
+		{"ascii", "Moana", ""},
+		{"cjk", "千と千尋の神隠し", ""},
+		{"emoji", "🎬 Moana 🌊", ""},
+		// 500 characters are 1500 bytes in CJK and 2000 bytes in emoji
+		{"500 cjk characters", strings.Repeat("映", 500), ""},
+		{"500 emoji", strings.Repeat("🎬", 500), ""},
+		{"501 cjk characters", strings.Repeat("映", 501), "must not be more than 500 characters long"},
+		{"501 emoji", strings.Repeat("🎬", 501), "must not be more than 500 characters long"},
+		{"empty", "", "must be provided"},
+		{"only whitespace", " \t\n ", "must be provided"},
+		{"only ideographic spaces", "　　", "must be provided"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := validMovie()
+			movie.Title = tt.title
+
+			v := validator.New()
+			ValidateMovie(v, movie)
+
+			if got := v.Errors["title"]; got != tt.wantError {
+				t.Errorf("got title error %q, want %q", got, tt.wantError)
+			}
+		})
+	}
+}
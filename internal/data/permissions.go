@@ -3,29 +3,128 @@ package data
 import (
 	"context"
 	"slices"
+	"strings"
 	"time"
-
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // define a permissions slice which we will use to hold the permissions codes
 // such as movies:react and movies:write
 type Permissions []string
 
+// Include reports whether the permissions have the code, ignoring the differences
+// removed by NormalizePermissionCode
 func (p Permissions) Include(code string) bool {
-	return slices.Contains(p, code)
+	code = NormalizePermissionCode(code)
+
+	return slices.ContainsFunc(p, func(permission string) bool {
+		return NormalizePermissionCode(permission) == code
+	})
+}
+
+// NormalizePermissionCode returns the canonical form of a permission code, trimmed
+// and in lower case. Every code is normalized before it's stored or compared, so
+// Movies:Read and movies:read are the same permission
+func NormalizePermissionCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// NormalizePermissionCodes returns a copy of the codes normalized with
+// NormalizePermissionCode
+func NormalizePermissionCodes(codes []string) []string {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = NormalizePermissionCode(code)
+	}
+
+	return normalized
+}
+
+// PermissionCodes are the permission codes checked by the API, seeded by cmd/seed
+var PermissionCodes = Permissions{
+	"api_keys:read",
+	"api_keys:write",
+	"audit:read",
+	"features:read",
+	"features:write",
+	"imports:write",
+	"maintenance:write",
+	"metrics:read",
+	"movies:read",
+	"movies:write",
+	"permissions:read",
+	"permissions:write",
+	"tokens:read",
+	"tokens:write",
+	"users:write",
 }
 
 type PermissionModel struct {
-	DB *pgxpool.Pool
+	DB DB
 }
 
-func NewPermissionModel(db *pgxpool.Pool) *PermissionModel {
+func NewPermissionModel(db DB) *PermissionModel {
 	return &PermissionModel{
 		DB: db,
 	}
 }
 
+// Insert creates the permissions with the given codes, skipping the ones that already
+// exist, and returns how many were created
+func (m PermissionModel) Insert(codes ...string) (int64, error) {
+	query := `
+		INSERT INTO permissions (code)
+		SELECT DISTINCT seed.code FROM unnest($1::text[]) AS seed(code)
+		WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE lower(permissions.code) = seed.code)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, NormalizePermissionCodes(codes))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// GetAll returns the codes of every permission in the system, sorted alphabetically
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 func (m PermissionModel) GetAllForUser(userID string) (Permissions, error) {
 	query := `
                 SELECT permissions.code
@@ -58,7 +157,7 @@ func (m PermissionModel) GetAllForUser(userID string) (Permissions, error) {
 			return nil, err
 		}
 
-		permissions = append(permissions, permission)
+		permissions = append(permissions, NormalizePermissionCode(permission))
 	}
 
 	if err = rows.Err(); err != nil {
@@ -71,12 +170,59 @@ func (m PermissionModel) GetAllForUser(userID string) (Permissions, error) {
 func (m PermissionModel) AddForUser(userID string, codes ...string) error {
 	query := `
 		INSERT INTO user_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		SELECT $1, permissions.id FROM permissions WHERE lower(permissions.code) = ANY($2)
+		ON CONFLICT DO NOTHING
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.Exec(ctx, query, userID, codes)
+	_, err := m.DB.Exec(ctx, query, userID, NormalizePermissionCodes(codes))
 	return err
 }
+
+// AddForUsers grants the permissions with the given codes to every user in a single
+// insert, skipping the permissions the users already have. It returns the number of
+// permissions granted
+func (m PermissionModel) AddForUsers(userIDs []string, codes []string) (int64, error) {
+	query := `
+		INSERT INTO user_permissions
+		SELECT users.id, permissions.id
+		FROM unnest($1::uuid[]) AS users(id)
+		CROSS JOIN permissions
+		WHERE lower(permissions.code) = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userIDs, NormalizePermissionCodes(codes))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// RemoveForUsers revokes the permissions with the given codes from every user and
+// returns the number of permissions revoked
+func (m PermissionModel) RemoveForUsers(userIDs []string, codes []string) (int64, error) {
+	query := `
+		DELETE FROM user_permissions
+		USING permissions
+		WHERE user_permissions.permission_id = permissions.id
+		AND user_permissions.user_id = ANY($1::uuid[])
+		AND lower(permissions.code) = ANY($2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userIDs, NormalizePermissionCodes(codes))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
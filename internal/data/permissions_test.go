@@ -0,0 +1,46 @@
+package data
+
+import "testing"
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{"same case", Permissions{"movies:read"}, "movies:read", true},
+		{"mixed case grant", Permissions{"Movies:Read"}, "movies:read", true},
+		{"upper case grant", Permissions{"MOVIES:WRITE"}, "movies:write", true},
+		{"mixed case check", Permissions{"movies:read"}, "Movies:Read", true},
+		{"surrounding whitespace", Permissions{" movies:read\t"}, "movies:read", true},
+		{"other permission", Permissions{"Movies:Read"}, "movies:write", false},
+		{"no permissions", nil, "movies:read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.Include(tt.code); got != tt.want {
+				t.Errorf("got Include(%q) %t, want %t", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePermissionCodes(t *testing.T) {
+	codes := []string{"Movies:Read", " MOVIES:WRITE ", "users:write"}
+
+	got := NormalizePermissionCodes(codes)
+
+	want := []string{"movies:read", "movies:write", "users:write"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q at %d, want %q", got[i], i, want[i])
+		}
+	}
+
+	// the codes are copied, not normalized in place
+	if codes[0] != "Movies:Read" {
+		t.Errorf("the codes were changed to %q", codes)
+	}
+}
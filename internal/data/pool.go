@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPoolBusy is returned when no connection of the pool became free within the
+// acquire timeout
+var ErrPoolBusy = errors.New("database connection pool busy")
+
+// AcquireTimeoutDB runs the queries on a pool, bounding the time spent waiting for a
+// free connection with its own timeout. Without it the wait eats into the timeout of
+// the query, and a saturated pool makes every query time out instead of failing fast
+type AcquireTimeoutDB struct {
+	Pool           *pgxpool.Pool
+	AcquireTimeout time.Duration
+
+	acquires atomic.Int64
+	timeouts atomic.Int64
+	waitTime atomic.Int64
+}
+
+func NewAcquireTimeoutDB(pool *pgxpool.Pool, acquireTimeout time.Duration) *AcquireTimeoutDB {
+	return &AcquireTimeoutDB{
+		Pool:           pool,
+		AcquireTimeout: acquireTimeout,
+	}
+}
+
+// Stats returns the number of connections acquired, the number of acquisitions that
+// timed out and the total time spent waiting for a connection
+func (db *AcquireTimeoutDB) Stats() (acquires int64, timeouts int64, waitTime time.Duration) {
+	return db.acquires.Load(), db.timeouts.Load(), time.Duration(db.waitTime.Load())
+}
+
+func (db *AcquireTimeoutDB) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, db.AcquireTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := db.Pool.Acquire(acquireCtx)
+	db.waitTime.Add(int64(time.Since(start)))
+
+	if err != nil {
+		// only the acquire timeout means the pool is busy, the deadline of the query
+		// context is reported as is
+		if ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+			db.timeouts.Add(1)
+			return nil, ErrPoolBusy
+		}
+		return nil, err
+	}
+
+	db.acquires.Add(1)
+
+	return conn, nil
+}
+
+func (db *AcquireTimeoutDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer conn.Release()
+
+	return conn.Exec(ctx, sql, args...)
+}
+
+// Query keeps the connection until the rows are closed
+func (db *AcquireTimeoutDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return &acquiredRows{Rows: rows, conn: conn}, nil
+}
+
+func (db *AcquireTimeoutDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &acquiredRow{db: db, ctx: ctx, sql: sql, args: args}
+}
+
+type acquiredRows struct {
+	pgx.Rows
+	conn *pgxpool.Conn
+}
+
+func (r *acquiredRows) Close() {
+	r.Rows.Close()
+
+	// Close() can be called more than once
+	if r.conn != nil {
+		r.conn.Release()
+		r.conn = nil
+	}
+}
+
+// acquiredRow defers the query until Scan() is called, like pgx does
+type acquiredRow struct {
+	db   *AcquireTimeoutDB
+	ctx  context.Context
+	sql  string
+	args []any
+}
+
+func (r *acquiredRow) Scan(dest ...any) error {
+	conn, err := r.db.acquire(r.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	return conn.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// QueryTagDB wraps a DB and prepends a comment with the tag to every query, e.g.
+// /* request_id='...' */, so the queries seen in the PostgreSQL logs and in
+// pg_stat_activity can be traced back to the API request which ran them.
+//
+// Every tag makes a different SQL text, which pgx would prepare and cache as a new
+// statement, evicting the statements of the untagged queries from the cache. The
+// tagged queries are run with the unnamed statement instead, see queryExecMode.
+type QueryTagDB struct {
+	DB      DB
+	comment string
+}
+
+// queryExecMode describes each tagged query on the unnamed statement before running
+// it, so nothing is cached. The exec and simple protocol modes would save that round
+// trip, but they guess the parameter types from the Go values and can't encode some
+// of the arguments of the models, like the map of the audit log changes.
+var queryExecMode = pgx.QueryExecModeDescribeExec
+
+func NewQueryTagDB(db DB, tag string) *QueryTagDB {
+	// the tag can't close the comment early
+	tag = strings.ReplaceAll(tag, "*/", "* /")
+
+	return &QueryTagDB{
+		DB:      db,
+		comment: "/* " + tag + " */ ",
+	}
+}
+
+func (db *QueryTagDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return db.DB.Exec(ctx, db.comment+sql, withExecMode(args)...)
+}
+
+func (db *QueryTagDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return db.DB.Query(ctx, db.comment+sql, withExecMode(args)...)
+}
+
+func (db *QueryTagDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return db.DB.QueryRow(ctx, db.comment+sql, withExecMode(args)...)
+}
+
+// withExecMode returns the arguments of a query preceded by queryExecMode, which is
+// how pgx takes the mode of a single query
+func withExecMode(args []any) []any {
+	return append([]any{queryExecMode}, args...)
+}
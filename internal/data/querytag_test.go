@@ -0,0 +1,68 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestQueryTagDB(t *testing.T) {
+	recorder := &queryRecorder{}
+
+	// the tag can't close the comment and run its own SQL
+	db := NewQueryTagDB(recorder, "request_id='*/ DROP TABLE movies; /*'")
+
+	db.Exec(context.Background(), "UPDATE movies SET title = $1", "Moana")
+	db.Query(context.Background(), "SELECT id FROM movies WHERE year = $1", 2016)
+	db.QueryRow(context.Background(), "SELECT title FROM movies WHERE id = $1", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81").Scan()
+
+	wantArgs := [][]any{{"Moana"}, {2016}, {"0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81"}}
+
+	if len(recorder.queries) != len(wantArgs) {
+		t.Fatalf("got %d queries, want %d", len(recorder.queries), len(wantArgs))
+	}
+
+	for i, sql := range recorder.queries {
+		if !strings.HasPrefix(sql, "/* request_id='* / DROP TABLE movies; /*' */ ") {
+			t.Errorf("got query %q without the tag comment", sql)
+		}
+
+		// the tagged queries must not be prepared and cached by pgx
+		args := recorder.args[i]
+		if len(args) == 0 || args[0] != pgx.QueryExecModeDescribeExec {
+			t.Errorf("got arguments %v, want the describe exec mode first", args)
+			continue
+		}
+		if !slices.Equal(args[1:], wantArgs[i]) {
+			t.Errorf("got arguments %v, want %v", args[1:], wantArgs[i])
+		}
+	}
+}
+
+func TestQueryTagDBSlowQueryLog(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	// wired as in main, the slow query log sees the tagged SQL
+	slow := NewSlowQueryDB(&queryRecorder{}, 0, logger)
+	db := NewQueryTagDB(slow, "request_id='"+strings.Repeat("a", 120)+"'")
+
+	db.Exec(context.Background(), "UPDATE movies SET title = $1 WHERE id = $2", "Moana", "0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81")
+
+	var entry struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("got log %q: %v", logs.String(), err)
+	}
+
+	if want := "UPDATE movies SET title = $1 WHERE id = $2"; entry.Query != want {
+		t.Errorf("got query %q, want %q", entry.Query, want)
+	}
+}
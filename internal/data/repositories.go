@@ -0,0 +1,83 @@
+package data
+
+import "time"
+
+// The repositories are the interfaces of the models used by the handlers, so the
+// handlers can be tested with the fakes of the mocks package instead of a database
+
+type MovieRepository interface {
+	Insert(movie *Movie) error
+	Upsert(movie *Movie) (bool, error)
+	Get(id string) (*Movie, error)
+	Update(movie *Movie) error
+	Delete(id string) error
+	GetRandom(genres []string, statuses []string) (*Movie, error)
+	Suggest(prefix string, limit int) ([]*Movie, error)
+	Count(title string, genres []string, statuses []string) (int, error)
+	GetAll(title string, genres []string, statuses []string, filters Filters) ([]*Movie, Metadata, error)
+	GetHistory(id string, filters Filters) ([]*MovieVersion, Metadata, error)
+}
+
+type UserRepository interface {
+	Insert(user *User) error
+	InsertIfNew(user *User) error
+	GetByEmail(email string) (*User, error)
+	Update(user *User) error
+	GetForToken(tokenScope string, tokenPlainText string) (*User, error)
+	GetForTokenWithPermissions(tokenScope string, tokenPlainText string) (*User, Permissions, *Token, error)
+	SetRateLimit(userID string, limit *RateLimit) error
+	GetMissingIDs(ids []string) ([]string, error)
+}
+
+type TokenRepository interface {
+	New(userID string, ttl time.Duration, scope string) (*Token, error)
+	NewEmailChange(userID string, ttl time.Duration, pendingEmail string) (*Token, error)
+	Insert(token *Token) error
+	GetPendingEmail(tokenPlainText string) (string, error)
+	DeleteAllForUser(scope string, userID string) error
+	DeleteOldestForUser(scope string, userID string, keep int) error
+	ExtendExpiry(hash []byte, expiry time.Time) error
+	GetAllFiltered(scope string, filters Filters) ([]*TokenSession, Metadata, error)
+	DeleteAllFiltered(userID string, scope string) (int64, error)
+}
+
+type PermissionRepository interface {
+	Insert(codes ...string) (int64, error)
+	GetAll() (Permissions, error)
+	GetAllForUser(userID string) (Permissions, error)
+	AddForUser(userID string, codes ...string) error
+	AddForUsers(userIDs []string, codes []string) (int64, error)
+	RemoveForUsers(userIDs []string, codes []string) (int64, error)
+}
+
+type AuditRepository interface {
+	Record(actorID string, action string, target string, changes map[string]any) error
+	GetAll(actorID string, action string, filters Filters) ([]*AuditEntry, Metadata, error)
+}
+
+type APIKeyRepository interface {
+	Insert(key *APIKey) error
+	GetAll() ([]*APIKey, error)
+	Revoke(id string) error
+	GetOwnerForKey(plaintext string) (*User, Permissions, error)
+}
+
+type FailedTaskRepository interface {
+	Insert(task *FailedTask) error
+}
+
+type FeatureFlagRepository interface {
+	GetAll() (map[string]*FeatureFlag, error)
+	Set(flag *FeatureFlag) error
+}
+
+var (
+	_ MovieRepository       = (*MovieModel)(nil)
+	_ UserRepository        = (*UserModel)(nil)
+	_ TokenRepository       = (*TokenModel)(nil)
+	_ PermissionRepository  = (*PermissionModel)(nil)
+	_ AuditRepository       = (*AuditModel)(nil)
+	_ APIKeyRepository      = (*APIKeyModel)(nil)
+	_ FailedTaskRepository  = (*FailedTaskModel)(nil)
+	_ FeatureFlagRepository = (*FeatureFlagModel)(nil)
+)
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SlowQueryDB wraps a DB and logs at WARN level the queries that take longer than
+// Threshold. Only the SQL text is logged, never the arguments, because they might
+// contain personal data.
+type SlowQueryDB struct {
+	DB        DB
+	Threshold time.Duration
+	Logger    *slog.Logger
+}
+
+func NewSlowQueryDB(db DB, threshold time.Duration, logger *slog.Logger) *SlowQueryDB {
+	return &SlowQueryDB{
+		DB:        db,
+		Threshold: threshold,
+		Logger:    logger,
+	}
+}
+
+func (db *SlowQueryDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	start := time.Now()
+	defer db.logIfSlow(sql, start)
+
+	return db.DB.Exec(ctx, sql, args...)
+}
+
+// Query measures the time until the rows are closed, so the time spent reading the
+// rows is included
+func (db *SlowQueryDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	start := time.Now()
+
+	rows, err := db.DB.Query(ctx, sql, args...)
+	if err != nil {
+		db.logIfSlow(sql, start)
+		return rows, err
+	}
+
+	return &slowQueryRows{Rows: rows, db: db, sql: sql, start: start}, nil
+}
+
+func (db *SlowQueryDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &slowQueryRow{db: db, sql: sql, row: func() pgx.Row { return db.DB.QueryRow(ctx, sql, args...) }}
+}
+
+func (db *SlowQueryDB) logIfSlow(sql string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed < db.Threshold {
+		return
+	}
+
+	db.Logger.Warn("slow database query", "query", queryIdentifier(sql), "elapsed", elapsed.String())
+}
+
+type slowQueryRows struct {
+	pgx.Rows
+	db     *SlowQueryDB
+	sql    string
+	start  time.Time
+	closed bool
+}
+
+func (r *slowQueryRows) Close() {
+	r.Rows.Close()
+
+	// Close() can be called more than once
+	if !r.closed {
+		r.closed = true
+		r.db.logIfSlow(r.sql, r.start)
+	}
+}
+
+type slowQueryRow struct {
+	db  *SlowQueryDB
+	sql string
+	row func() pgx.Row
+}
+
+func (r *slowQueryRow) Scan(dest ...any) error {
+	start := time.Now()
+	defer r.db.logIfSlow(r.sql, start)
+
+	return r.row().Scan(dest...)
+}
+
+// queryIdentifier collapses the whitespace of the SQL text and truncates it, so it can
+// be logged in a single line. The leading comment of QueryTagDB is dropped, otherwise
+// the tag would take up the logged text instead of the query
+func queryIdentifier(sql string) string {
+	sql = strings.TrimSpace(sql)
+	if strings.HasPrefix(sql, "/*") {
+		if _, after, found := strings.Cut(sql, "*/"); found {
+			sql = after
+		}
+	}
+
+	identifier := strings.Join(strings.Fields(sql), " ")
+
+	if len(identifier) > 120 {
+		identifier = identifier[:120] + "..."
+	}
+
+	return identifier
+}
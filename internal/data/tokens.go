@@ -2,17 +2,21 @@ package data
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email-change"
 )
 
 type Token struct {
@@ -21,15 +25,59 @@ type Token struct {
 	UserID    string    `json:"-"` // string because it's an UUID value
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	// PendingEmail is only used by email-change tokens and holds the new email
+	// address that will replace the current one once the token is confirmed
+	PendingEmail string `json:"-"`
+}
+
+// tokenHashSecret is the key of the HMAC-SHA256 hashes of the tokens, so a copy of
+// the tokens table isn't enough to check guessed tokens. When it's empty the tokens
+// are hashed with plain SHA-256
+var tokenHashSecret []byte
+
+// acceptLegacyTokenHashes makes the lookups also match the plain SHA-256 hashes, so
+// the tokens created before the secret was set keep working until they expire
+var acceptLegacyTokenHashes = true
+
+// SetTokenHashSecret sets the secret used to hash new tokens and whether the tokens
+// hashed without it are still accepted
+func SetTokenHashSecret(secret string, acceptLegacy bool) {
+	tokenHashSecret = []byte(secret)
+	acceptLegacyTokenHashes = acceptLegacy
+}
+
+// hashToken returns the hash stored for the token
+func hashToken(tokenPlaintext string) []byte {
+	if len(tokenHashSecret) == 0 {
+		hash := sha256.Sum256([]byte(tokenPlaintext))
+		// hash will return an "array" of length 32, to make it easier to work with we
+		// convert it to a slice using [:] operator
+		return hash[:]
+	}
+
+	mac := hmac.New(sha256.New, tokenHashSecret)
+	mac.Write([]byte(tokenPlaintext))
+
+	return mac.Sum(nil)
+}
+
+// tokenLookupHashes returns every hash the token may be stored with, the current one
+// first, to look it up with hash = ANY(...)
+func tokenLookupHashes(tokenPlaintext string) [][]byte {
+	hashes := [][]byte{hashToken(tokenPlaintext)}
+
+	if len(tokenHashSecret) > 0 && acceptLegacyTokenHashes {
+		legacy := sha256.Sum256([]byte(tokenPlaintext))
+		hashes = append(hashes, legacy[:])
+	}
+
+	return hashes
 }
 
 func generateToken(userID string, ttl time.Duration, scope string) *Token {
 	token := &Token{Plaintext: rand.Text(), UserID: userID, Expiry: time.Now().Add(ttl), Scope: scope}
-
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	// hash will return an "array" of length 32, to make it easier to work with we convert it
-	// to a slice using [:] operator before storing it
-	token.Hash = hash[:]
+	token.Hash = hashToken(token.Plaintext)
 
 	return token
 }
@@ -40,10 +88,10 @@ func ValidateTokenPlainText(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *pgxpool.Pool
+	DB DB
 }
 
-func NewTokenModel(db *pgxpool.Pool) *TokenModel {
+func NewTokenModel(db DB) *TokenModel {
 	return &TokenModel{
 		DB: db,
 	}
@@ -57,20 +105,66 @@ func (m *TokenModel) New(userID string, ttl time.Duration, scope string) (*Token
 	return token, err
 }
 
+// NewEmailChange creates an email-change token which stores the new email address
+// until the user confirms it
+func (m *TokenModel) NewEmailChange(userID string, ttl time.Duration, pendingEmail string) (*Token, error) {
+	token := generateToken(userID, ttl, ScopeEmailChange)
+	token.PendingEmail = pendingEmail
+
+	err := m.Insert(token)
+
+	return token, err
+}
+
 func (m *TokenModel) Insert(token *Token) error {
 	query := `
-                INSERT INTO tokens (hash, user_id, expiry, scope)
-                VALUES ($1, $2, $3, $4)
+                INSERT INTO tokens (hash, user_id, expiry, scope, pending_email)
+                VALUES ($1, $2, $3, $4, $5)
         `
 
+	// store NULL instead of an empty string for the tokens without a pending email
+	var pendingEmail *string
+	if token.PendingEmail != "" {
+		pendingEmail = &token.PendingEmail
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.Exec(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	_, err := m.DB.Exec(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, pendingEmail)
 
 	return err
 }
 
+// GetPendingEmail returns the new email address stored in a valid email-change token
+func (m *TokenModel) GetPendingEmail(tokenPlainText string) (string, error) {
+	query := `
+                SELECT pending_email
+                FROM tokens
+                WHERE hash = ANY($1)
+                AND scope = $2
+                AND expiry > $3
+                AND pending_email IS NOT NULL
+        `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var pendingEmail string
+
+	err := m.DB.QueryRow(ctx, query, tokenLookupHashes(tokenPlainText), ScopeEmailChange, time.Now()).Scan(&pendingEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return pendingEmail, nil
+}
+
 func (m *TokenModel) DeleteAllForUser(scope string, userID string) error {
 	query := `
                 DELETE FROM tokens
@@ -84,3 +178,129 @@ func (m *TokenModel) DeleteAllForUser(scope string, userID string) error {
 
 	return err
 }
+
+// DeleteOldestForUser deletes the expired tokens of the user with the given scope,
+// and the oldest active ones so only the newest keep tokens remain
+func (m *TokenModel) DeleteOldestForUser(scope string, userID string, keep int) error {
+	// the expiry of a token is extended while it's used, so it doesn't tell the
+	// oldest tokens apart, the creation date does. created_at only has a precision
+	// of seconds, the tokens created in the same second are ordered by expiry
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash NOT IN (
+			SELECT hash FROM tokens
+			WHERE scope = $1 AND user_id = $2 AND expiry > now()
+			ORDER BY created_at DESC, expiry DESC
+			LIMIT $3
+		)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, scope, userID, keep)
+
+	return err
+}
+
+// ExtendExpiry sets a new expiry for the token with the given hash
+func (m *TokenModel) ExtendExpiry(hash []byte, expiry time.Time) error {
+	query := `
+		UPDATE tokens
+		SET expiry = $2
+		WHERE hash = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, hash, expiry)
+
+	return err
+}
+
+// TokenSession describes an active token for the admin view, without its hash
+type TokenSession struct {
+	UserID    string    `json:"user_id"`
+	UserEmail string    `json:"user_email"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// GetAllFiltered returns the tokens that haven't expired yet along with their user,
+// optionally only the ones of the given scope (an empty scope matches every scope)
+func (m *TokenModel) GetAllFiltered(scope string, filters Filters) ([]*TokenSession, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), tokens.user_id, users.email, tokens.scope, tokens.created_at, tokens.expiry
+		FROM tokens
+		INNER JOIN users
+		ON users.id = tokens.user_id
+		WHERE tokens.expiry > now()
+		AND (tokens.scope = $1 OR $1 = '')
+		ORDER BY %s %s, tokens.hash
+		LIMIT $2 OFFSET $3
+	`, "tokens."+filters.getSortColumn(), filters.getSortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, scope, filters.getLimit(), filters.getOffSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	sessions := []*TokenSession{}
+
+	for rows.Next() {
+		var session TokenSession
+		err := rows.Scan(
+			&totalRecords,
+			&session.UserID,
+			&session.UserEmail,
+			&session.Scope,
+			&session.CreatedAt,
+			&session.Expiry,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return sessions, metadata, nil
+}
+
+// DeleteAllFiltered deletes the tokens of the given user and scope, an empty userID or
+// scope matches every user or scope, but not both at the same time. It returns the
+// number of deleted tokens
+func (m *TokenModel) DeleteAllFiltered(userID string, scope string) (int64, error) {
+	if userID == "" && scope == "" {
+		return 0, errors.New("deleting every token requires a user or a scope")
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE (user_id = NULLIF($1, '')::uuid OR $1 = '')
+		AND (scope = $2 OR $2 = '')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, scope)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
@@ -2,15 +2,16 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
+	_ "embed"
 	"errors"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/giancarlosisasi/greenlight-api/internal/validator"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -27,6 +28,25 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// RateLimit overrides the global rate limit for this user, nil means no override.
+	// It's only loaded along with the authentication token
+	RateLimit *RateLimit `json:"-"`
+}
+
+// RateLimit is a token bucket rate limit: RPS requests per second with bursts of up
+// to Burst requests
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// rateLimitOverride builds the rate limit override of a user from its nullable columns
+func rateLimitOverride(rps *float64, burst *int) *RateLimit {
+	if rps == nil || burst == nil {
+		return nil
+	}
+
+	return &RateLimit{RPS: *rps, Burst: *burst}
 }
 
 type password struct {
@@ -35,7 +55,7 @@ type password struct {
 }
 
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := passwordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -46,18 +66,22 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+// SetHash sets a password hashed elsewhere, e.g. by the system the user is imported
+// from. The hash must have been made with one of the supported algorithms
+func (p *password) SetHash(hash string) error {
+	if !hasherFor([]byte(hash)).Valid([]byte(hash)) {
+		return errInvalidPasswordHash
 	}
 
-	return true, nil
+	p.plainText = nil
+	p.hash = []byte(hash)
+
+	return nil
+}
+
+// Matches checks the password with the algorithm that made its hash
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	return hasherFor(p.hash).Matches(p.hash, plaintextPassword)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -71,6 +95,89 @@ func ValidatePasswordPlainText(v *validator.Validator, password string) {
 	v.Check(len(password) <= 24, "password", "password must be at least 72 bytes long")
 }
 
+// commonPasswords holds a small blocklist of passwords that are too common to be
+// accepted when the PasswordPolicy.RejectCommon rule is enabled
+//
+//go:embed "passwords/common.txt"
+var commonPasswordsFile string
+
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	passwords := make(map[string]bool)
+
+	for line := range strings.Lines(commonPasswordsFile) {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+
+	return passwords
+})
+
+// PasswordPolicy holds the optional rules applied by ValidatePasswordStrength. The
+// zero value disables all the rules.
+type PasswordPolicy struct {
+	// MinCharacterClasses is the minimum number of character classes (lowercase,
+	// uppercase, digits and symbols) that the password must contain
+	MinCharacterClasses int
+	// RejectCommon rejects passwords that are part of the common passwords blocklist
+	RejectCommon bool
+	// RejectEmail rejects passwords that contain the local part of the user email
+	RejectEmail bool
+}
+
+// ValidatePasswordStrength checks the password against the rules of the policy. The
+// failed rules are reported together in the "password" field error.
+func ValidatePasswordStrength(v *validator.Validator, policy PasswordPolicy, password string, email string) {
+	var failed []string
+
+	if policy.MinCharacterClasses > 0 && countCharacterClasses(password) < policy.MinCharacterClasses {
+		failed = append(failed, v.Sprintf("must contain at least %d of the following: lowercase letters, uppercase letters, digits and symbols", policy.MinCharacterClasses))
+	}
+
+	if policy.RejectCommon && commonPasswords()[strings.ToLower(password)] {
+		failed = append(failed, v.Translate("is too common"))
+	}
+
+	if policy.RejectEmail {
+		localPart, _, _ := strings.Cut(email, "@")
+		// very short local parts would reject too many legit passwords
+		if len(localPart) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(localPart)) {
+			failed = append(failed, v.Translate("must not contain your email address"))
+		}
+	}
+
+	if len(failed) > 0 {
+		v.AddError("password", strings.Join(failed, "; "))
+	}
+}
+
+func countCharacterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	count := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			count++
+		}
+	}
+
+	return count
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
@@ -94,10 +201,10 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *pgxpool.Pool
+	DB DB
 }
 
-func NewUserModel(db *pgxpool.Pool) *UserModel {
+func NewUserModel(db DB) *UserModel {
 	return &UserModel{
 		DB: db,
 	}
@@ -139,6 +246,35 @@ func (m *UserModel) Insert(user *User) error {
 	return nil
 }
 
+// InsertIfNew works like Insert but skips the user when the email address is already
+// taken. It returns ErrDuplicatedEmail in that case too, but without failing the
+// query, so the transaction it runs in can go on
+func (m *UserModel) InsertIfNew(user *User) error {
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id, created_at, version
+	`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrDuplicatedEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (m *UserModel) GetByEmail(email string) (*User, error) {
 	query := `
                 SELECT id, created_at, name, email, password_hash, activated, version
@@ -214,16 +350,12 @@ func (m *UserModel) Update(user *User) error {
 }
 
 func (m *UserModel) GetForToken(tokenScope string, tokenPlainText string) (*User, error) {
-	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	// Remember that this returns a byte *array* with length 32, not a slice.
-	tokenHash := sha256.Sum256([]byte(tokenPlainText))
-
 	query := `
 		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
-		WHERE tokens.hash = $1
+		WHERE tokens.hash = ANY($1)
 		AND tokens.scope = $2
 		AND tokens.expiry > $3
 	`
@@ -232,7 +364,8 @@ func (m *UserModel) GetForToken(tokenScope string, tokenPlainText string) (*User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRow(ctx, query, tokenHash[:], tokenScope, time.Now()).Scan(
+	// the token is looked up with every hash it may be stored with, see tokenLookupHashes()
+	err := m.DB.QueryRow(ctx, query, tokenLookupHashes(tokenPlainText), tokenScope, time.Now()).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
@@ -254,6 +387,136 @@ func (m *UserModel) GetForToken(tokenScope string, tokenPlainText string) (*User
 	return &user, nil
 }
 
+// GetForTokenWithPermissions works like GetForToken, but it also returns the
+// permission codes of the user and the token itself (without its plaintext), fetching
+// all of them in a single round trip
+func (m *UserModel) GetForTokenWithPermissions(tokenScope string, tokenPlainText string) (*User, Permissions, *Token, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.rate_limit_rps, users.rate_limit_burst,
+			COALESCE(array_agg(lower(permissions.code)) FILTER (WHERE permissions.code IS NOT NULL), '{}'),
+			tokens.hash, tokens.expiry, tokens.created_at
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		LEFT JOIN user_permissions
+		ON users.id = user_permissions.user_id
+		LEFT JOIN permissions
+		ON user_permissions.permission_id = permissions.id
+		WHERE tokens.hash = ANY($1)
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		GROUP BY users.id, tokens.hash
+	`
+	var user User
+	var permissions Permissions
+	var rps *float64
+	var burst *int
+	token := Token{Scope: tokenScope}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, tokenLookupHashes(tokenPlainText), tokenScope, time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&rps,
+		&burst,
+		&permissions,
+		&token.Hash,
+		&token.Expiry,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, nil, err
+		}
+	}
+
+	user.RateLimit = rateLimitOverride(rps, burst)
+	token.UserID = user.ID
+
+	return &user, permissions, &token, nil
+}
+
+// SetRateLimit sets the rate limit override of the user, or removes it when limit is
+// nil
+func (m *UserModel) SetRateLimit(userID string, limit *RateLimit) error {
+	query := `
+		UPDATE users
+		SET rate_limit_rps = $1, rate_limit_burst = $2
+		WHERE id = $3
+	`
+
+	var rps *float64
+	var burst *int
+	if limit != nil {
+		rps = &limit.RPS
+		burst = &limit.Burst
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, rps, burst, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetMissingIDs returns the IDs of the list which don't belong to any user. The IDs
+// must be valid UUIDs
+func (m *UserModel) GetMissingIDs(ids []string) ([]string, error) {
+	query := `
+		SELECT ids.id
+		FROM unnest($1::uuid[]) AS ids(id)
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = ids.id)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := []string{}
+
+	for rows.Next() {
+		var id string
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		missing = append(missing, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
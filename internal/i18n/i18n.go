@@ -0,0 +1,97 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// DefaultLocale is the locale used when the client doesn't ask for a supported one.
+// The messages in the code base are written in this locale and they are used as the
+// keys of the other catalogs, so it doesn't need a catalog file.
+const DefaultLocale = "en"
+
+//go:embed "locales"
+var localesFS embed.FS
+
+// catalogs maps a locale (e.g. "es") to its messages, keyed by the English message
+var catalogs = loadCatalogs()
+
+var matcher = language.NewMatcher(supportedTags())
+
+func loadCatalogs() map[string]map[string]string {
+	entries, err := localesFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	catalogs := make(map[string]map[string]string)
+
+	for _, entry := range entries {
+		content, err := localesFS.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		var messages map[string]string
+		err = json.Unmarshal(content, &messages)
+		if err != nil {
+			// the catalogs are embedded in the binary, so an invalid file is a bug
+			panic(fmt.Sprintf("invalid locale file %s: %v", entry.Name(), err))
+		}
+
+		catalogs[strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))] = messages
+	}
+
+	return catalogs
+}
+
+func supportedTags() []language.Tag {
+	// the first tag is the fallback used by the matcher
+	tags := []language.Tag{language.Make(DefaultLocale)}
+
+	for locale := range catalogs {
+		tags = append(tags, language.Make(locale))
+	}
+
+	return tags
+}
+
+// MatchAcceptLanguage returns the supported locale that best matches the value of an
+// Accept-Language header, falling back to DefaultLocale
+func MatchAcceptLanguage(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return DefaultLocale
+	}
+
+	tag, _, _ := matcher.Match(tags...)
+	base, _ := tag.Base()
+
+	if _, ok := catalogs[base.String()]; !ok {
+		return DefaultLocale
+	}
+
+	return base.String()
+}
+
+// Translate returns the message in the given locale. If the locale or the message
+// are not in the catalogs, the message is returned as is.
+func Translate(locale string, message string) string {
+	translated, ok := catalogs[locale][message]
+	if !ok {
+		return message
+	}
+
+	return translated
+}
+
+// Sprintf translates the format string before formatting it, so messages with
+// dynamic values can be translated as well
+func Sprintf(locale string, format string, args ...any) string {
+	return fmt.Sprintf(Translate(locale, format), args...)
+}
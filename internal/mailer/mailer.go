@@ -2,15 +2,32 @@ package mailer
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	ht "html/template"
 	tt "text/template"
 
+	"github.com/giancarlosisasi/greenlight-api/internal/i18n"
 	"gopkg.in/gomail.v2"
 )
 
+// The templates are organized in a directory per locale (e.g. templates/es), a
+// template which isn't in the directory of a locale is loaded from the directory of
+// i18n.DefaultLocale instead.
+//
 // Below we declare a nw variable with the tpe embed.FS (embedded file system) to hold
 // our email templates. THis has a comment directive in the format `//go:embed <path>`
 // IMMEDIATELY ABOVE it, which indicates to Go that we want to store the contents of the
@@ -25,47 +42,261 @@ var templateFS embed.FS
 type Mailer struct {
 	client *gomail.Dialer
 	sender string
+	// sendSlots bounds the number of emails being sent at the same time, so a spike of
+	// emails doesn't open more connections than the SMTP server accepts. Each send
+	// attempt takes a slot and gives it back once it's done
+	sendSlots chan struct{}
+	// MaxBodySize is the maximum size in bytes of the subject and each body of an
+	// email, 0 means no limit
+	MaxBodySize int
+	// dir is set by NewFileMailer, the emails are written to it instead of being sent
+	dir string
 }
 
-func NewDialer(host string, port int, username string, password string, sender string) *Mailer {
+// ErrBodyTooLarge is returned by Send() when a template renders more than MaxBodySize
+// bytes
+var ErrBodyTooLarge = errors.New("mailer: email body too large")
+
+// limitedWriter writes to w until n bytes have been written and fails after that, so
+// a template that goes out of hand stops rendering instead of allocating without
+// bound
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > lw.n {
+		written, err := lw.w.Write(p[:lw.n])
+		lw.n -= written
+		if err != nil {
+			return written, err
+		}
+		return written, ErrBodyTooLarge
+	}
+
+	written, err := lw.w.Write(p)
+	lw.n -= written
+	return written, err
+}
+
+// templateExecutor is implemented by both text/template and html/template
+type templateExecutor interface {
+	ExecuteTemplate(w io.Writer, name string, data any) error
+}
+
+// render executes the named template into a buffer bounded by MaxBodySize
+func (m *Mailer) render(tmpl templateExecutor, name string, data any) (string, error) {
+	buf := new(bytes.Buffer)
+
+	var w io.Writer = buf
+	if m.MaxBodySize > 0 {
+		w = &limitedWriter{w: buf, n: m.MaxBodySize}
+	}
+
+	err := tmpl.ExecuteTemplate(w, name, data)
+	if err != nil {
+		// the template package wraps the errors of the writer
+		if errors.Is(err, ErrBodyTooLarge) {
+			return "", fmt.Errorf("%w: %s is larger than %d bytes", ErrBodyTooLarge, name, m.MaxBodySize)
+		}
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// NewDialer returns a Mailer which sends at most concurrency emails at the same time
+func NewDialer(host string, port int, username string, password string, sender string, concurrency int) *Mailer {
 	d := gomail.NewDialer(host, port, username, password)
 
 	mailer := &Mailer{
-		client: d,
-		sender: sender,
+		client:    d,
+		sender:    sender,
+		sendSlots: make(chan struct{}, concurrency),
 	}
 
 	return mailer
 }
 
-// Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the template, and any
-// dynamic data for the templates as an any parameter
-func (m *Mailer) Send(recipient string, templateFile string, data any) error {
-	// Use the ParseFS() method text/template to parse the required template file
-	// from the embedded file system
-	textTmpl, err := tt.New("").ParseFS(templateFS, "templates/"+templateFile)
+// NewFileMailer returns a Mailer for local development, which writes every email to
+// an .eml file in dir (created if needed) instead of sending it, so the rendered
+// templates can be opened with any email client
+func NewFileMailer(dir string, sender string) (*Mailer, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	mailer := &Mailer{
+		sender: sender,
+		dir:    dir,
+	}
+
+	return mailer, nil
+}
+
+// writeFile writes the message to a new file of the output directory. The name starts
+// with the time, so the files are listed in the order the emails were sent
+func (m *Mailer) writeFile(recipient string, templateFile string, msg *gomail.Message) error {
+	name := fmt.Sprintf("%s-%s-%s.eml",
+		time.Now().UTC().Format("20060102T150405.000000000"),
+		strings.TrimSuffix(templateFile, filepath.Ext(templateFile)),
+		fileNameReplacer.Replace(recipient),
+	)
+	path := filepath.Join(m.dir, name)
+
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	plainBody := new(bytes.Buffer)
-	err = textTmpl.ExecuteTemplate(plainBody, "plainBody", data)
+
+	_, err = msg.WriteTo(f)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
-	subject := new(bytes.Buffer)
-	err = textTmpl.ExecuteTemplate(subject, "subject", data)
+	return f.Close()
+}
+
+// fileNameReplacer removes the characters of an email address that aren't safe in a
+// file name
+var fileNameReplacer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "<", "_", ">", "_")
+
+// Ping checks that the SMTP server is reachable: it connects to it and sends a NOOP
+// command, without authenticating nor sending any email. The context deadline bounds
+// the whole check
+func (m *Mailer) Ping(ctx context.Context) error {
+	if m.dir != "" {
+		_, err := os.Stat(m.dir)
+		return err
+	}
+
+	addr := net.JoinHostPort(m.client.Host, strconv.Itoa(m.client.Port))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
 
-	htmlTmpl, err := ht.New("").ParseFS(templateFS, "templates/"+templateFile)
+	// the connection is encrypted from the start when using implicit TLS (port 465)
+	if m.client.SSL {
+		tlsConfig := m.client.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: m.client.Host}
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, m.client.Host)
 	if err != nil {
 		return err
 	}
-	htmlBody := new(bytes.Buffer)
-	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	defer client.Close()
+
+	err = client.Noop()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// dialAndSend sends the message once a send slot is free
+func (m *Mailer) dialAndSend(msg *gomail.Message) error {
+	m.sendSlots <- struct{}{}
+	defer func() { <-m.sendSlots }()
+
+	return m.client.DialAndSend(msg)
+}
+
+// templatePath returns the path of the template in the directory of the locale, or in
+// the directory of i18n.DefaultLocale when it hasn't been translated to the locale
+func templatePath(locale string, templateFile string) (string, error) {
+	for _, dir := range []string{locale, i18n.DefaultLocale} {
+		path := "templates/" + dir + "/" + templateFile
+
+		// the error can only be a missing file or an invalid locale, and both mean
+		// the next directory has to be tried
+		_, err := fs.Stat(templateFS, path)
+		if err == nil {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("mailer: template %s not found", templateFile)
+}
+
+// Templates returns the names of the template files, e.g. user_welcome.tmpl
+func Templates() []string {
+	entries, err := fs.ReadDir(templateFS, "templates/"+i18n.DefaultLocale)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+// Email is the rendered content of an email
+type Email struct {
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// Render executes the subject, plainBody and htmlBody templates of the template file
+// in the language of locale, without sending anything
+func (m *Mailer) Render(locale string, templateFile string, data any) (*Email, error) {
+	path, err := templatePath(locale, templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the ParseFS() method text/template to parse the required template file
+	// from the embedded file system
+	textTmpl, err := tt.New("").ParseFS(templateFS, path)
+	if err != nil {
+		return nil, err
+	}
+	plainBody, err := m.render(textTmpl, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := m.render(textTmpl, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := ht.New("").ParseFS(templateFS, path)
+	if err != nil {
+		return nil, err
+	}
+	htmlBody, err := m.render(htmlTmpl, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Email{Subject: subject, PlainBody: plainBody, HTMLBody: htmlBody}, nil
+}
+
+// Define a Send() method on the Mailer type. This takes the locale of the recipient,
+// their email address, the name of the file containing the template, and any dynamic
+// data for the templates as an any parameter
+func (m *Mailer) Send(locale string, recipient string, templateFile string, data any) error {
+	email, err := m.Render(locale, templateFile, data)
 	if err != nil {
 		return err
 	}
@@ -74,12 +305,16 @@ func (m *Mailer) Send(recipient string, templateFile string, data any) error {
 
 	msg.SetHeader("From", m.sender)
 	msg.SetHeader("To", recipient)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg.SetHeader("Subject", email.Subject)
+	msg.SetBody("text/plain", email.PlainBody)
+	msg.AddAlternative("text/html", email.HTMLBody)
+
+	if m.dir != "" {
+		return m.writeFile(recipient, templateFile, msg)
+	}
 
 	for i := 1; i < 3; i++ {
-		err = m.client.DialAndSend(msg)
+		err = m.dialAndSend(msg)
 		if err == nil {
 			return nil
 		}
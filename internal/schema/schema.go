@@ -0,0 +1,113 @@
+// Package schema validates request bodies against the JSON Schemas embedded in the
+// schemas directory. It complements the validator package for constraints that are
+// easier to express on the raw payload, like the shape of nested objects.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+//go:embed "schemas/*.json"
+var schemasFS embed.FS
+
+// schemas holds the compiled schemas by name, which is the file name without the
+// .json extension
+var schemas = mustCompile()
+
+var printer = message.NewPrinter(language.English)
+
+func mustCompile() map[string]*jsonschema.Schema {
+	files, err := fs.Glob(schemasFS, "schemas/*.json")
+	if err != nil {
+		panic(err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiled := make(map[string]*jsonschema.Schema, len(files))
+
+	for _, file := range files {
+		content, err := schemasFS.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(content))
+		if err != nil {
+			panic(fmt.Sprintf("invalid JSON schema %s: %v", file, err))
+		}
+
+		err = compiler.AddResource(file, doc)
+		if err != nil {
+			panic(fmt.Sprintf("invalid JSON schema %s: %v", file, err))
+		}
+
+		sch, err := compiler.Compile(file)
+		if err != nil {
+			panic(fmt.Sprintf("invalid JSON schema %s: %v", file, err))
+		}
+
+		compiled[strings.TrimSuffix(path.Base(file), ".json")] = sch
+	}
+
+	return compiled
+}
+
+// Validate validates the JSON body against the named schema. It returns the
+// violations keyed by the path of the offending field, with dots between the
+// segments (e.g. "genres.0"), and nil when the body is valid. Naming a schema that
+// doesn't exist is a bug, so it panics.
+func Validate(name string, body []byte) (map[string]string, error) {
+	sch, ok := schemas[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown JSON schema %q", name))
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sch.Validate(doc)
+	if err == nil {
+		return nil, nil
+	}
+
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil, err
+	}
+
+	violations := make(map[string]string)
+	collectViolations(validationErr, violations)
+
+	return violations, nil
+}
+
+// collectViolations adds the leaf errors of the tree to violations, keeping the first
+// error of each field
+func collectViolations(err *jsonschema.ValidationError, violations map[string]string) {
+	if len(err.Causes) == 0 {
+		field := strings.Join(err.InstanceLocation, ".")
+		if field == "" {
+			field = "body"
+		}
+
+		if _, exists := violations[field]; !exists {
+			violations[field] = err.ErrorKind.LocalizedString(printer)
+		}
+		return
+	}
+
+	for _, cause := range err.Causes {
+		collectViolations(cause, violations)
+	}
+}
@@ -1,22 +1,38 @@
 package validator
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"regexp"
 	"slices"
+	"time"
+
+	"github.com/giancarlosisasi/greenlight-api/internal/i18n"
 )
 
 // Declare a regular expression for sanity checking the format of email addresses (we'll use this later)
 
 var (
+	UUIDRX  = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
 type Validator struct {
 	Errors map[string]string
+	locale string
+	// fields holds the keys of Errors in the order they were added
+	fields []string
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return NewWithLocale(i18n.DefaultLocale)
+}
+
+// NewWithLocale returns a validator which translates the error messages to the given locale
+func NewWithLocale(locale string) *Validator {
+	return &Validator{Errors: make(map[string]string), locale: locale}
 }
 
 // Valid returns true if the errors mp doesn't contain any entries
@@ -27,8 +43,59 @@ func (v *Validator) Valid() bool {
 // AddError adds an error message to the map (so long as no entry already exists for the given key)
 func (v *Validator) AddError(key string, message string) {
 	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+		v.Errors[key] = i18n.Translate(v.locale, message)
+		v.fields = append(v.fields, key)
+	}
+}
+
+// FieldErrors returns the errors in the order they were added, which follows the order
+// of the checks, so the responses list them in a stable and meaningful order
+func (v *Validator) FieldErrors() FieldErrors {
+	return FieldErrors{fields: v.fields, errors: v.Errors}
+}
+
+// FieldErrors is encoded as a JSON object whose keys keep the order of the checks,
+// unlike a map which is always encoded with its keys sorted
+type FieldErrors struct {
+	fields []string
+	errors map[string]string
+}
+
+func (fe FieldErrors) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i, field := range fe.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(fe.errors[field])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
 	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// Translate returns the message translated to the validator locale
+func (v *Validator) Translate(message string) string {
+	return i18n.Translate(v.locale, message)
+}
+
+// Sprintf translates the format to the validator locale before formatting it
+func (v *Validator) Sprintf(format string, args ...any) string {
+	return fmt.Sprintf(v.Translate(format), args...)
 }
 
 // Checks adds an error message to the map only if a validation check is not ok
@@ -48,6 +115,28 @@ func Matches(value string, rx *regexp.Regexp) bool {
 	return rx.MatchString(value)
 }
 
+// IsUUID returns true if the value is a UUID in its canonical textual form.
+func IsUUID(value string) bool {
+	return UUIDRX.MatchString(value)
+}
+
+// IsURL returns true if the value is an absolute http or https URL with a host.
+func IsURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// IsDate returns true if the value is a date (or a time) in the given layout, e.g.
+// time.DateOnly for ISO dates like 2006-01-02.
+func IsDate(value string, layout string) bool {
+	_, err := time.Parse(layout, value)
+	return err == nil
+}
+
 // Generic function which returns true if all values in a slice are unique.
 func Unique[T comparable](values []T) bool {
 	uniqueValues := make(map[T]bool)
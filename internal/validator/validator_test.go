@@ -0,0 +1,109 @@
+package validator
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestIsUUID(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81", true},
+		{"0190F6A2-7C1E-7D3A-9B8E-2F4C5D6E7F81", true},
+		{"", false},
+		{"abc", false},
+		{"0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8", false},
+		{"0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f811", false},
+		{"0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f8g", false},
+		{"0190f6a27c1e7d3a9b8e2f4c5d6e7f81", false},
+		{"{0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81}", false},
+		{" 0190f6a2-7c1e-7d3a-9b8e-2f4c5d6e7f81", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsUUID(tt.value); got != tt.want {
+			t.Errorf("IsUUID(%q) = %t, want %t", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com:8080/hooks?token=abc", true},
+		{"https://例え.jp/path", true},
+		{"", false},
+		{"example.com", false},
+		{"/relative/path", false},
+		{"ftp://example.com", false},
+		{"javascript:alert(1)", false},
+		{"https://", false},
+		{"http://exa mple.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsURL(tt.value); got != tt.want {
+			t.Errorf("IsURL(%q) = %t, want %t", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsDate(t *testing.T) {
+	tests := []struct {
+		value  string
+		layout string
+		want   bool
+	}{
+		{"2024-02-29", time.DateOnly, true},
+		{"2023-02-29", time.DateOnly, false},
+		{"2024-13-01", time.DateOnly, false},
+		{"2024-1-1", time.DateOnly, false},
+		{"", time.DateOnly, false},
+		{"2024-02-29T10:00:00Z", time.DateOnly, false},
+		{"2024-02-29T10:00:00Z", time.RFC3339, true},
+		{"2024-02-29T10:00:00+05:00", time.RFC3339, true},
+		{"2024-02-29", time.RFC3339, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsDate(tt.value, tt.layout); got != tt.want {
+			t.Errorf("IsDate(%q, %q) = %t, want %t", tt.value, tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestFieldErrorsMarshalJSON(t *testing.T) {
+	v := New()
+
+	v.Check(false, "name", "must be provided")
+	v.Check(false, "email", "must be a valid email address")
+	v.Check(false, "name", "must not be more than 500 bytes long")
+	v.Check(true, "password", "must be provided")
+	v.Check(false, "a \"quoted\" field", "must be <escaped>")
+
+	js, err := json.Marshal(v.FieldErrors())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys keep the order of the checks instead of being sorted, and only the
+	// first error of a field is kept
+	want := `{"name":"must be provided","email":"must be a valid email address","a \"quoted\" field":"must be \u003cescaped\u003e"}`
+	if string(js) != want {
+		t.Errorf("got %s, want %s", js, want)
+	}
+
+	js, err = json.Marshal(New().FieldErrors())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != "{}" {
+		t.Errorf("got %s for no errors, want {}", js)
+	}
+}
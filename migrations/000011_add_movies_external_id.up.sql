@@ -0,0 +1 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS external_id text UNIQUE;
\ No newline at end of file
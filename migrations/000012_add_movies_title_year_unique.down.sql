@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS movies_title_year_key;
+ALTER TABLE movies DROP COLUMN IF EXISTS unique_title_year;
\ No newline at end of file
@@ -0,0 +1,10 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS unique_title_year boolean NOT NULL DEFAULT false;
+
+-- the oldest movie of each title and year takes part in the uniqueness check, so
+-- existing duplicates don't prevent the index from being created
+UPDATE movies SET unique_title_year = true
+WHERE id IN (
+    SELECT DISTINCT ON (title, year) id FROM movies ORDER BY title, year, created_at
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS movies_title_year_key ON movies (title, year) WHERE unique_title_year;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  actor_id UUID REFERENCES users ON DELETE SET NULL,
+  action text NOT NULL,
+  target text NOT NULL,
+  changes jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_id_idx ON audit_log (actor_id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action);
\ No newline at end of file
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  name text NOT NULL,
+  hash bytea NOT NULL UNIQUE,
+  owner_id UUID NOT NULL REFERENCES users ON DELETE CASCADE,
+  permissions text[] NOT NULL DEFAULT '{}',
+  revoked_at timestamp(0) with time zone
+);
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_rate_limit_check;
+ALTER TABLE users DROP COLUMN IF EXISTS rate_limit_burst;
+ALTER TABLE users DROP COLUMN IF EXISTS rate_limit_rps;
\ No newline at end of file
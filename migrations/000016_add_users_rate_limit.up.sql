@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rate_limit_rps double precision;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS rate_limit_burst integer;
+ALTER TABLE users ADD CONSTRAINT users_rate_limit_check CHECK (
+  (rate_limit_rps IS NULL AND rate_limit_burst IS NULL) OR (rate_limit_rps > 0 AND rate_limit_burst > 0)
+);
\ No newline at end of file
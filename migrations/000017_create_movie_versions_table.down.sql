@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS movies_record_version ON movies;
+DROP FUNCTION IF EXISTS movies_record_version();
+DROP TABLE IF EXISTS movie_versions;
\ No newline at end of file
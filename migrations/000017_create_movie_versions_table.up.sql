@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS movie_versions (
+  movie_id UUID NOT NULL REFERENCES movies ON DELETE CASCADE,
+  version integer NOT NULL,
+  replaced_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  title text NOT NULL,
+  year integer NOT NULL,
+  runtime integer NOT NULL,
+  genres text[] NOT NULL,
+  PRIMARY KEY (movie_id, version)
+);
+
+-- every change of a movie bumps its version, the trigger keeps the row as it was
+-- before the change, so no code path updating movies can skip the history
+CREATE OR REPLACE FUNCTION movies_record_version() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO movie_versions (movie_id, version, title, year, runtime, genres)
+  VALUES (OLD.id, OLD.version, OLD.title, OLD.year, OLD.runtime, OLD.genres)
+  ON CONFLICT DO NOTHING;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_record_version
+  AFTER UPDATE ON movies
+  FOR EACH ROW
+  WHEN (OLD.version IS DISTINCT FROM NEW.version)
+  EXECUTE FUNCTION movies_record_version();
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS failed_tasks;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS failed_tasks (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  task text NOT NULL,
+  attempts integer NOT NULL,
+  error text NOT NULL
+);
\ No newline at end of file
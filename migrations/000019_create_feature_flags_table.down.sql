@@ -0,0 +1 @@
+DROP TABLE IF EXISTS feature_flags;
\ No newline at end of file
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS feature_flags (
+  name text PRIMARY KEY,
+  enabled boolean NOT NULL,
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
\ No newline at end of file
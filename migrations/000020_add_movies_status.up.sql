@@ -0,0 +1,4 @@
+-- the existing movies were all visible, so they are published
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published';
+
+ALTER TABLE movies ADD CONSTRAINT movies_status_check CHECK (status IN ('draft', 'published', 'archived'));
\ No newline at end of file
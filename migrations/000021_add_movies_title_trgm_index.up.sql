@@ -0,0 +1,4 @@
+-- pg_trgm ships with the PostgreSQL contrib modules, see the README
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS movies_title_trgm_idx ON movies USING GIN (title gin_trgm_ops);
\ No newline at end of file